@@ -1,23 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/ankur-anand/telchat/pkg"
 )
 
 var configLocation = flag.String("config", "./config.json", "config.json file location")
 
-type config struct {
-	LogFile    string `json:"log_file"`
-	TelnetAddr string `json:"telnet_addr"`
-	HTTPAddr   string `json:"http_addr"`
-}
+const defaultShutdownTimeout = 5 * time.Second
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds | log.LUTC | log.Lmsgprefix)
@@ -30,23 +30,79 @@ func main() {
 		log.Fatal(err)
 	}
 
-	var cg config
+	var cg pkg.Config
 	err = json.Unmarshal(cb, &cg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// token subcommand manage the REST API tokens without starting the server.
+	if flag.Arg(0) == "token" {
+		err = tokenCommand(cg, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	cs, err := pkg.NewChatServer(cg.LogFile)
+	cs, err := pkg.NewChatServer(cg)
 	log.Printf("log will be written to %s \n", cg.LogFile)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	go cs.ServeHTTP(cg.HTTPAddr)
 	go cs.ServeTelnet(cg.TelnetAddr)
+	if cg.HTTPSAddr != "" {
+		go cs.ServeHTTPS(cg.HTTPSAddr)
+	}
+	if cg.TelnetTLSAddr != "" {
+		go cs.ServeTelnetTLS(cg.TelnetTLSAddr)
+	}
+	if cg.SSHAddr != "" {
+		go cs.ServeSSH(cg.SSHAddr)
+	}
 
 	<-c
 	log.Printf("shutting down server")
-	cs.Shutdown()
+	timeout := time.Duration(cg.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = cs.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown err: %v", err)
+	}
+}
+
+const tokenUsage = "usage: token issue [name] | token revoke [id]"
+
+// tokenCommand issues or revokes a REST API token in the configured tokens file.
+func tokenCommand(cg pkg.Config, args []string) error {
+	if cg.TokensFile == "" {
+		return errors.New("tokens_file is not configured")
+	}
+	if len(args) != 2 {
+		return errors.New(tokenUsage)
+	}
+	switch args[0] {
+	case "issue":
+		id, token, err := pkg.IssueToken(cg.TokensFile, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id: %s\ntoken: %s\n", id, token)
+	case "revoke":
+		err := pkg.RevokeToken(cg.TokensFile, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("revoked token %s\n", args[1])
+	default:
+		return errors.New(tokenUsage)
+	}
+	return nil
 }
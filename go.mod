@@ -1,3 +1,10 @@
 module github.com/ankur-anand/telchat
 
-go 1.14
+go 1.24.0
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.45.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
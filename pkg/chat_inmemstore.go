@@ -3,10 +3,12 @@ package pkg
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
-	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,8 +19,8 @@ const (
 
 var (
 	errDuplicateClient = errors.New("duplicate client")
-	errNilConn         = errors.New("nil connection")
-	noTimeout          = time.Time{}
+	errNilConn         = errors.New("nil session")
+	errUnknownClient   = errors.New("unknown client")
 )
 
 type (
@@ -31,13 +33,15 @@ type (
 
 // client is each unique client that is connected to the chatServer
 type client struct {
-	conn net.Conn
+	sess *queuedSession
 	// ignoreList contains all the list of client that a client has decided to ignore
 	ignoreList map[clientID]struct{}
+	// notify is false when the client has turned off the join and leave notices.
+	notify bool
 }
 
 type (
-	subscriber map[clientID]net.Conn
+	subscriber map[clientID]session
 
 	chatDataStore struct {
 		logWriter io.Writer
@@ -47,16 +51,32 @@ type (
 		clients map[clientID]*client
 		// roomsSubscribers store all the client subscriber to particular room.
 		roomsSubscribers map[roomID]subscriber
+		// roomsWatchers store all the anonymous sessions watching particular room,
+		// like the live room streams.
+		roomsWatchers map[roomID]map[session]struct{}
+		// rooms holds the metadata of every room.
+		rooms *roomMetaStore
+		// outbound configures the outbound queue of each registered client.
+		outbound queueConfig
+		metrics  deliveryMetrics
 	}
 )
 
 func newChatDataStore(lw io.Writer) *chatDataStore {
+	return newChatDataStoreWithQueue(lw, defaultQueueConfig, newRoomMetaStore())
+}
+
+func newChatDataStoreWithQueue(lw io.Writer, qc queueConfig, rs *roomMetaStore) *chatDataStore {
 	cds := chatDataStore{
+		outbound:         qc,
 		logWriter:        lw,
 		clients:          make(map[clientID]*client),
 		roomsSubscribers: make(map[roomID]subscriber),
+		roomsWatchers:    make(map[roomID]map[session]struct{}),
+		rooms:            rs,
 	}
 	cds.roomsSubscribers[metaRoom] = make(subscriber)
+	cds.rooms.create(metaRoom, "")
 	return &cds
 }
 
@@ -68,23 +88,25 @@ func (cds *chatDataStore) isDuplicateClient(clientName string) bool {
 
 // registerClient registers the given client to the chat data store.
 // all the registered client will be by default part of the meta room.
-func (cds *chatDataStore) registerClient(clientName string, conn net.Conn) error {
+func (cds *chatDataStore) registerClient(clientName string, sess session) error {
 	cds.lock.Lock()
 	defer cds.lock.Unlock()
 	if cds.isDuplicateClient(clientName) {
 		return errDuplicateClient
 	}
 
-	if conn == nil {
+	if sess == nil {
 		return errNilConn
 	}
 	cid := clientID(clientName)
 	client := &client{
-		conn:       conn,
+		sess:       newQueuedSession(sess, cds.outbound, &cds.metrics),
 		ignoreList: make(map[clientID]struct{}),
+		notify:     true,
 	}
 	cds.clients[cid] = client
-	cds.roomsSubscribers[metaRoom][cid] = conn
+	cds.roomsSubscribers[metaRoom][cid] = client.sess
+	cds.notifyPresence(cid, metaRoom, "joined")
 	return nil
 }
 
@@ -93,15 +115,27 @@ func (cds *chatDataStore) registerClient(clientName string, conn net.Conn) error
 func (cds *chatDataStore) addClientToRoom(clientName, roomName string) {
 	cds.lock.Lock()
 	defer cds.lock.Unlock()
-	cid := clientID(clientName)
-	roomId := roomID(roomName)
+	cds.enterRoom(clientID(clientName), roomID(roomName))
+}
+
+// enterRoom adds the client to the room store, creating the room if needed.
+// It must be called with the lock held.
+func (cds *chatDataStore) enterRoom(cid clientID, roomId roomID) {
 	client, ok := cds.clients[cid]
+	if !ok {
+		return
+	}
 	// add the client to room store
 	_, ok = cds.roomsSubscribers[roomId]
 	if !ok {
 		cds.roomsSubscribers[roomId] = make(subscriber)
+		cds.createRoomMeta(roomId, cid)
 	}
-	cds.roomsSubscribers[roomId][cid] = client.conn
+	if _, ok := cds.roomsSubscribers[roomId][cid]; ok {
+		return
+	}
+	cds.roomsSubscribers[roomId][cid] = client.sess
+	cds.notifyPresence(cid, roomId, "joined")
 }
 
 // removeClientFromRoom deregister the client from the given room in the chat
@@ -109,11 +143,24 @@ func (cds *chatDataStore) addClientToRoom(clientName, roomName string) {
 func (cds *chatDataStore) removeClientFromRoom(clientName, roomName string) {
 	cds.lock.Lock()
 	defer cds.lock.Unlock()
-	cid := clientID(clientName)
-	roomId := roomID(roomName)
-	// delete the client from room store
+	cds.leaveRoom(clientID(clientName), roomID(roomName))
+}
+
+// leaveRoom deletes the client from the room store and reclaims the room
+// once its last member has left, except for the meta room. The metadata of the
+// rooms reclaimed is kept only if something was set for them.
+// It must be called with the lock held.
+func (cds *chatDataStore) leaveRoom(cid clientID, roomId roomID) {
 	roomM := cds.roomsSubscribers[roomId]
+	if _, ok := roomM[cid]; !ok {
+		return
+	}
 	delete(roomM, cid)
+	cds.notifyPresence(cid, roomId, "left")
+	if len(roomM) == 0 && roomId != metaRoom {
+		delete(cds.roomsSubscribers, roomId)
+		cds.pruneRoomMeta(roomId)
+	}
 }
 
 // deleteClient from the client data store as well as from
@@ -122,7 +169,120 @@ func (cds *chatDataStore) deleteClient(clientName string) {
 	cds.lock.Lock()
 	defer cds.lock.Unlock()
 	cid := clientID(clientName)
+	client, ok := cds.clients[cid]
+	if ok {
+		client.sess.stop()
+	}
 	delete(cds.clients, cid)
+	for roomId := range cds.roomsSubscribers {
+		cds.leaveRoom(cid, roomId)
+	}
+}
+
+// notifyPresence delivers the notice that the client has joined or left the room
+// to the other members of the room, unless they have turned off notices or ignore the client.
+// It must be called with the lock held.
+func (cds *chatDataStore) notifyPresence(cid clientID, roomId roomID, action string) {
+	m := newSystemMessage(string(roomId), fmt.Sprintf("%s %s #%s", cid, action, roomId))
+	for keyCID, sess := range cds.roomsSubscribers[roomId] {
+		if keyCID == cid {
+			continue
+		}
+		if cl, ok := cds.clients[keyCID]; ok {
+			if _, ignored := cl.ignoreList[cid]; ignored || !cl.notify {
+				continue
+			}
+		}
+		cds.deliver(sess, m)
+	}
+	for sess := range cds.roomsWatchers[roomId] {
+		cds.deliver(sess, m)
+	}
+}
+
+// setNotify turns on or off the join and leave notices for the client.
+func (cds *chatDataStore) setNotify(clientName string, on bool) {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	if cl, ok := cds.clients[clientID(clientName)]; ok {
+		cl.notify = on
+	}
+}
+
+// roomInfo is the name and member count of a room.
+type roomInfo struct {
+	Name    roomID `json:"name"`
+	Members int    `json:"members"`
+}
+
+// listRooms returns all the rooms with their member count, sorted by name.
+func (cds *chatDataStore) listRooms() []roomInfo {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	rooms := make([]roomInfo, 0, len(cds.roomsSubscribers))
+	for roomId, roomM := range cds.roomsSubscribers {
+		rooms = append(rooms, roomInfo{Name: roomId, Members: len(roomM)})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+// roomMembers returns the clients that are part of the room sorted by name,
+// and false if there is no such room.
+func (cds *chatDataStore) roomMembers(roomName string) ([]clientID, bool) {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	roomM, ok := cds.roomsSubscribers[roomID(roomName)]
+	members := make([]clientID, 0, len(roomM))
+	for cid := range roomM {
+		members = append(members, cid)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i] < members[j]
+	})
+	return members, ok
+}
+
+// clientRooms returns the sorted rooms the client is member of.
+func (cds *chatDataStore) clientRooms(clientName string) []roomID {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	cid := clientID(clientName)
+	rooms := make([]roomID, 0)
+	for roomId, roomM := range cds.roomsSubscribers {
+		if _, ok := roomM[cid]; ok {
+			rooms = append(rooms, roomId)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i] < rooms[j]
+	})
+	return rooms
+}
+
+// activeRoom returns the room the client commands apply to, the given room unless the client
+// is no longer a member of it, like once kicked or banned from it. The meta room is preferred
+// then, else the first of the other rooms of the client. moved is true if the room changed.
+func (cds *chatDataStore) activeRoom(clientName, roomName string) (room string, moved bool) {
+	if cds.isRoomMember(clientName, roomName) {
+		return roomName, false
+	}
+	rooms := cds.clientRooms(clientName)
+	room = string(metaRoom)
+	if len(rooms) > 0 && !cds.isRoomMember(clientName, room) {
+		room = string(rooms[0])
+	}
+	return room, true
+}
+
+// isRoomMember returns true if the client is member of the room.
+func (cds *chatDataStore) isRoomMember(clientName, roomName string) bool {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	_, ok := cds.roomsSubscribers[roomID(roomName)][clientID(clientName)]
+	return ok
 }
 
 // ignoreNamedClient add the proposed client in the current client ignore list
@@ -143,71 +303,206 @@ func (cds *chatDataStore) allowNamedClient(myName, clientName string) {
 	delete(cds.clients[mid].ignoreList, cid)
 }
 
-// broadcast the given message to the room that the client is currently
-// part of.
-func (cds *chatDataStore) broadcastMsg(ctx context.Context, clientName, roomName string, msg []byte) {
+// broadcastMsg relays the given message to the room of the message, to every client
+// part of it and every session watching it.
+// Delivery never blocks, each client session queues the message for its own writer.
+func (cds *chatDataStore) broadcastMsg(ctx context.Context, m chatMessage) {
+	select {
+	case <-ctx.Done():
+		return
+	default:
+	}
 	cds.lock.RLock()
 	defer cds.lock.RUnlock()
-	cid := clientID(clientName)
-	roomId := roomID(roomName)
-	roomM := cds.roomsSubscribers[roomId]
-	// IMP: Note
-	// this sends the message one by one over an unsupervised goroutine.
-	// No of goroutine spawned is not accounted, and also msg is dropped
-	// if there is timeout while writing or an error while writing to the socket.
-	for keyCID, conn := range roomM {
-		// if keyCID is equal to cid don't relay the msg
-		if keyCID == cid {
+	// the messages of the banned and muted clients are not delivered.
+	if r, ok := cds.rooms.get(m.Room); ok && r.canSend(m.Sender, time.Now()) != nil {
+		return
+	}
+	roomM := cds.roomsSubscribers[m.Room]
+	for keyCID, sess := range roomM {
+		// if keyCID is equal to sender don't relay the msg
+		if keyCID == m.Sender {
 			continue
 		}
-		// if cid is in the ignore list don't broadcast
+		// if sender is in the ignore list don't broadcast
 		cl, ok := cds.clients[keyCID]
 		if ok {
-			_, ok := cl.ignoreList[cid]
+			_, ok := cl.ignoreList[m.Sender]
 			if ok {
 				continue
 			}
 		}
-
-		go cds.sendMsg(ctx, conn, msg)
+		cds.deliver(sess, m)
+	}
+	for sess := range cds.roomsWatchers[m.Room] {
+		cds.deliver(sess, m)
 	}
 }
 
-// sendMsg Sends the given MSG to the client
-func (cds *chatDataStore) sendMsg(ctx context.Context, conn net.Conn, msg []byte) {
-	cds.lock.RLock()
-	defer cds.lock.RUnlock()
-	err := conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+// deliver hands over the message to the session.
+func (cds *chatDataStore) deliver(sess session, m chatMessage) {
+	err := sess.deliver(m)
 	if err != nil {
-		log.Printf("SetWriteDeadline failed: %v\n", err)
+		log.Printf("failed delivering a message to %s: %v\n", sess.remoteIdentity(), err)
 	}
-	defer func() {
-		// reuse write conn.
-		err := conn.SetWriteDeadline(noTimeout)
-		if err != nil {
-			log.Printf("SetWriteDeadline failed: %v\n", err)
-		}
-	}()
+}
+
+// directMsg delivers the private message only to its recipient, unless the recipient ignores the sender.
+func (cds *chatDataStore) directMsg(ctx context.Context, m chatMessage) error {
 	select {
 	case <-ctx.Done():
-		return
+		return ctx.Err()
 	default:
-		// these writes are not buffered
-		_, err := conn.Write(msg)
-		if err != nil {
-			log.Printf("failed sending a message to network: %v\n", err)
+	}
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	cl, ok := cds.clients[m.Recipient]
+	if !ok {
+		return errUnknownClient
+	}
+	if _, ok := cl.ignoreList[m.Sender]; ok {
+		return nil
+	}
+	cds.deliver(cl.sess, m)
+	return nil
+}
+
+// announce delivers a system notice with the given body once to every client and watcher,
+// labelled with one of the rooms it's in.
+func (cds *chatDataStore) announce(body string) {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	seen := make(map[session]struct{})
+	deliver := func(roomId roomID, sess session) {
+		if _, ok := seen[sess]; ok {
+			return
+		}
+		seen[sess] = struct{}{}
+		cds.deliver(sess, newSystemMessage(string(roomId), body))
+	}
+	for roomId, roomM := range cds.roomsSubscribers {
+		for _, sess := range roomM {
+			deliver(roomId, sess)
+		}
+	}
+	for roomId, watchers := range cds.roomsWatchers {
+		for sess := range watchers {
+			deliver(roomId, sess)
 		}
 	}
+	for _, cl := range cds.clients {
+		deliver(metaRoom, cl.sess)
+	}
 }
 
-// closeAllConn closes all active conn in the memory store.
-func (cds *chatDataStore) closeAllConn() {
+// waitClientsLeft waits for every client to leave, for at most d or until the ctx is done.
+func (cds *chatDataStore) waitClientsLeft(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		cds.lock.RLock()
+		left := len(cds.clients) == 0
+		cds.lock.RUnlock()
+		if left {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flushAll waits for the outbound queue of every client to be drained, or the ctx to be done.
+func (cds *chatDataStore) flushAll(ctx context.Context) error {
+	cds.lock.RLock()
+	queues := make([]*queuedSession, 0, len(cds.clients))
+	for _, cl := range cds.clients {
+		queues = append(queues, cl.sess)
+	}
+	cds.lock.RUnlock()
+	for _, qs := range queues {
+		if err := qs.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchRoom registers the session to receive every message of the given room,
+// without registering it as a client. unwatch deregister the session.
+func (cds *chatDataStore) watchRoom(roomName string, sess session) (unwatch func()) {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	roomId := roomID(roomName)
+	if _, ok := cds.roomsWatchers[roomId]; !ok {
+		cds.roomsWatchers[roomId] = make(map[session]struct{})
+	}
+	cds.roomsWatchers[roomId][sess] = struct{}{}
+	return func() {
+		cds.lock.Lock()
+		defer cds.lock.Unlock()
+		watchers := cds.roomsWatchers[roomId]
+		delete(watchers, sess)
+		if len(watchers) == 0 {
+			delete(cds.roomsWatchers, roomId)
+		}
+	}
+}
+
+// clientQueueMetrics is the outbound queue state of a single client.
+type clientQueueMetrics struct {
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// queueMetrics is the outbound queue state of the chat data store.
+type queueMetrics struct {
+	DroppedMessages         uint64                          `json:"dropped_messages"`
+	SlowConsumerDisconnects uint64                          `json:"slow_consumer_disconnects"`
+	Clients                 map[clientID]clientQueueMetrics `json:"clients"`
+}
+
+// outboundMetrics returns the snapshot of the outbound queues metrics.
+func (cds *chatDataStore) outboundMetrics() queueMetrics {
 	cds.lock.RLock()
 	defer cds.lock.RUnlock()
+	qm := queueMetrics{
+		DroppedMessages:         atomic.LoadUint64(&cds.metrics.dropped),
+		SlowConsumerDisconnects: atomic.LoadUint64(&cds.metrics.disconnected),
+		Clients:                 make(map[clientID]clientQueueMetrics, len(cds.clients)),
+	}
+	for cid, cl := range cds.clients {
+		qm.Clients[cid] = clientQueueMetrics{
+			Queued:  cl.sess.pending(),
+			Dropped: atomic.LoadUint64(&cl.sess.dropped),
+		}
+	}
+	return qm
+}
+
+// closeAllConn closes all active client and watcher sessions in the memory store.
+func (cds *chatDataStore) closeAllConn() {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
 	for _, v := range cds.clients {
-		err := v.conn.Close()
+		err := v.sess.close()
 		if err != nil {
-			log.Printf("error closing conn, err: %v", err)
+			log.Printf("error closing session, err: %v", err)
+		}
+	}
+	for roomId, watchers := range cds.roomsWatchers {
+		for sess := range watchers {
+			err := sess.close()
+			if err != nil {
+				log.Printf("error closing session, err: %v", err)
+			}
 		}
+		delete(cds.roomsWatchers, roomId)
 	}
 }
@@ -5,10 +5,69 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
 
+// newBodySession returns a session that writes only the message body to the conn.
+func newBodySession(conn net.Conn) session {
+	return newConnSession(conn, func(m chatMessage) []byte {
+		return []byte(m.Body)
+	})
+}
+
+// memSession is an in-memory session that records every delivered message.
+type memSession struct {
+	lock   sync.Mutex
+	name   string
+	msgs   []chatMessage
+	closed bool
+}
+
+func (ms *memSession) deliver(m chatMessage) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.closed {
+		return errSessionClosed
+	}
+	ms.msgs = append(ms.msgs, m)
+	return nil
+}
+
+func (ms *memSession) close() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.closed = true
+	return nil
+}
+
+func (ms *memSession) remoteIdentity() string {
+	return ms.name
+}
+
+func (ms *memSession) messages() []chatMessage {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]chatMessage(nil), ms.msgs...)
+}
+
+// waitMessages waits for the session to receive n messages.
+func (ms *memSession) waitMessages(t *testing.T, n int) []chatMessage {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := ms.messages(); len(msgs) >= n {
+			return msgs
+		}
+		time.Sleep(time.Millisecond)
+	}
+	msgs := ms.messages()
+	t.Errorf("expected %d messages got %d", n, len(msgs))
+	return msgs
+}
+
 func TestRegisterClient(t *testing.T) {
 	t.Parallel()
 	ds := newChatDataStore(ioutil.Discard)
@@ -17,11 +76,11 @@ func TestRegisterClient(t *testing.T) {
 		t.Errorf("expected nilConn err got nil")
 	}
 	server, _ := net.Pipe()
-	err = ds.registerClient("test-1", server)
+	err = ds.registerClient("test-1", newBodySession(server))
 	if err != nil {
 		t.Errorf("expected nil err got %v", err)
 	}
-	err = ds.registerClient("test-1", server)
+	err = ds.registerClient("test-1", newBodySession(server))
 	if err == nil {
 		t.Errorf("expected duplicate client err got nil")
 	}
@@ -36,15 +95,18 @@ func TestBroadcastMsgSubscribeAndUnSubscribeOnMetaRoom(t *testing.T) {
 	clients := make([]net.Conn, 0, 10)
 	for i := 0; i < 10; i++ {
 		server, client := net.Pipe()
-		err = ds.registerClient(fmt.Sprintf("test%d", i), server)
+		err = ds.registerClient(fmt.Sprintf("test%d", i), newBodySession(server))
 		if err != nil {
 			t.Errorf("expected nil err got %v", err)
 			continue
 		}
+		// only the broadcast messages are read below.
+		ds.setNotify(fmt.Sprintf("test%d", i), false)
 		servers = append(servers, server)
 		clients = append(clients, client)
 	}
-	msg := []byte("hi there")
+	dummyClient := "dummyClient"
+	msg := newChatMessage(dummyClient, roomName, "hi there", originREST)
 	testClientRead := func(t *testing.T) {
 		t.Helper()
 		for _, client := range clients {
@@ -62,8 +124,7 @@ func TestBroadcastMsgSubscribeAndUnSubscribeOnMetaRoom(t *testing.T) {
 	// broadcast to the all the servers on meta room
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	dummyClient := "dummyClient"
-	ds.broadcastMsg(ctx, dummyClient, roomName, msg)
+	ds.broadcastMsg(ctx, msg)
 	testClientRead(t)
 
 	// Unsubscribe one client.
@@ -71,7 +132,7 @@ func TestBroadcastMsgSubscribeAndUnSubscribeOnMetaRoom(t *testing.T) {
 	// again broadcast to the all the servers on meta room
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	ds.broadcastMsg(ctx, dummyClient, roomName, msg)
+	ds.broadcastMsg(ctx, msg)
 	for i, client := range clients {
 		err := client.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
 		if err != nil {
@@ -91,7 +152,7 @@ func TestBroadcastMsgSubscribeAndUnSubscribeOnMetaRoom(t *testing.T) {
 	ds.addClientToRoom("test9", roomName)
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	ds.broadcastMsg(ctx, dummyClient, roomName, msg)
+	ds.broadcastMsg(ctx, msg)
 	testClientRead(t)
 }
 
@@ -104,15 +165,18 @@ func TestBroadcastAddDeleteClientOnMetaRoom(t *testing.T) {
 	clients := make([]net.Conn, 0, 10)
 	for i := 0; i < 10; i++ {
 		server, client := net.Pipe()
-		err = ds.registerClient(fmt.Sprintf("test%d", i), server)
+		err = ds.registerClient(fmt.Sprintf("test%d", i), newBodySession(server))
 		if err != nil {
 			t.Errorf("expected nil err got %v", err)
 			continue
 		}
+		// only the broadcast messages are read below.
+		ds.setNotify(fmt.Sprintf("test%d", i), false)
 		servers = append(servers, server)
 		clients = append(clients, client)
 	}
-	msg := []byte("hi there")
+	dummyClient := "dummyClient"
+	msg := newChatMessage(dummyClient, roomName, "hi there", originREST)
 	testClientRead := func(t *testing.T) {
 		t.Helper()
 		for _, client := range clients {
@@ -130,8 +194,7 @@ func TestBroadcastAddDeleteClientOnMetaRoom(t *testing.T) {
 	// broadcast to the all the servers on meta room
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	dummyClient := "dummyClient"
-	ds.broadcastMsg(ctx, dummyClient, roomName, msg)
+	ds.broadcastMsg(ctx, msg)
 	testClientRead(t)
 
 	// Unsubscribe one client.
@@ -139,7 +202,7 @@ func TestBroadcastAddDeleteClientOnMetaRoom(t *testing.T) {
 	// again broadcast to the all the servers on meta room
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	ds.broadcastMsg(ctx, dummyClient, roomName, msg)
+	ds.broadcastMsg(ctx, msg)
 	for i, client := range clients {
 		err := client.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
 		if err != nil {
@@ -159,6 +222,196 @@ func TestBroadcastAddDeleteClientOnMetaRoom(t *testing.T) {
 	ds.allowNamedClient("test9", dummyClient)
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	ds.broadcastMsg(ctx, dummyClient, roomName, msg)
+	ds.broadcastMsg(ctx, msg)
 	testClientRead(t)
 }
+
+func TestBroadcastMsgMemSessionAndWatchers(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	ankur := &memSession{name: "ankur"}
+	anand := &memSession{name: "anand"}
+	watcher := &memSession{name: "watcher"}
+	must(t, ds.registerClient("ankur", ankur))
+	ds.setNotify("ankur", false)
+	must(t, ds.registerClient("anand", anand))
+	unwatch := ds.watchRoom(metaRoom, watcher)
+
+	ds.broadcastMsg(context.Background(), newChatMessage("ankur", metaRoom, "hi there", originTelnet))
+	for _, sess := range []*memSession{anand, watcher} {
+		msgs := sess.waitMessages(t, 1)
+		if len(msgs) == 1 && msgs[0].Body != "hi there" {
+			t.Errorf("expected msg hi there got %s", msgs[0].Body)
+		}
+	}
+	// sender should not receive its own message.
+	time.Sleep(time.Millisecond * 10)
+	if msgs := ankur.messages(); len(msgs) != 0 {
+		t.Errorf("expected sender to not receive its own message got %d", len(msgs))
+	}
+
+	unwatch()
+	ds.broadcastMsg(context.Background(), newChatMessage("ankur", metaRoom, "hi again", originTelnet))
+	anand.waitMessages(t, 2)
+	time.Sleep(time.Millisecond * 10)
+	if msgs := watcher.messages(); len(msgs) != 1 {
+		t.Errorf("expected unwatched session to receive no new message got %d", len(msgs))
+	}
+
+	ds.closeAllConn()
+	for _, sess := range []*memSession{ankur, anand} {
+		if err := sess.deliver(chatMessage{}); err != errSessionClosed {
+			t.Errorf("expected session to be closed got %v", err)
+		}
+	}
+}
+
+func TestNotifyPresence(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	ankur := &memSession{name: "ankur"}
+	anand := &memSession{name: "anand"}
+	watcher := &memSession{name: "watcher"}
+	must(t, ds.registerClient("ankur", ankur))
+	unwatch := ds.watchRoom("roomname", watcher)
+	defer unwatch()
+	must(t, ds.registerClient("anand", anand))
+
+	msgs := ankur.waitMessages(t, 1)
+	if len(msgs) == 1 && (msgs[0].Kind != kindSystem || msgs[0].Body != "anand joined #default") {
+		t.Errorf("expected join notice got %+v", msgs[0])
+	}
+
+	ds.removeClientFromRoom("anand", metaRoom)
+	ds.addClientToRoom("anand", "roomname")
+	msgs = ankur.waitMessages(t, 2)
+	if len(msgs) == 2 && msgs[1].Body != "anand left #default" {
+		t.Errorf("expected leave notice got %s", msgs[1].Body)
+	}
+	msgs = watcher.waitMessages(t, 1)
+	if len(msgs) == 1 && msgs[0].Body != "anand joined #roomname" {
+		t.Errorf("expected join notice got %s", msgs[0].Body)
+	}
+	// joining a room twice is not announced again.
+	ds.addClientToRoom("anand", "roomname")
+
+	// ignored clients and clients with the notices off are not notified.
+	ds.addClientToRoom("ankur", "roomname")
+	ds.ignoreNamedClient("anand", "ankur")
+	ds.removeClientFromRoom("ankur", "roomname")
+	ds.setNotify("ankur", false)
+	ds.deleteClient("anand")
+	time.Sleep(time.Millisecond * 10)
+	if msgs := anand.messages(); len(msgs) != 0 {
+		t.Errorf("expected no notice for ignoring client got %d", len(msgs))
+	}
+	if msgs := ankur.messages(); len(msgs) != 2 {
+		t.Errorf("expected no notice with notify off got %d", len(msgs))
+	}
+	if msgs := watcher.messages(); len(msgs) != 4 {
+		t.Errorf("expected watcher to receive every notice got %d", len(msgs))
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	ankur := &memSession{name: "ankur"}
+	watcher := &memSession{name: "watcher"}
+	must(t, ds.registerClient("ankur", ankur))
+	ds.setNotify("ankur", false)
+	ds.addClientToRoom("ankur", "roomname")
+	unwatch := ds.watchRoom(metaRoom, watcher)
+	defer unwatch()
+	unwatchRoom := ds.watchRoom("roomname", watcher)
+	defer unwatchRoom()
+
+	// the notice is delivered once, even to the clients and watchers of several rooms.
+	ds.announce("server shutting down")
+	for _, sess := range []*memSession{ankur, watcher} {
+		msgs := sess.waitMessages(t, 1)
+		if len(msgs) == 1 && (msgs[0].Kind != kindSystem || msgs[0].Body != "server shutting down") {
+			t.Errorf("expected shutdown notice got %+v", msgs[0])
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	for _, sess := range []*memSession{ankur, watcher} {
+		if msgs := sess.messages(); len(msgs) != 1 {
+			t.Errorf("expected %s to receive the notice once got %d", sess.name, len(msgs))
+		}
+	}
+}
+
+func TestDeleteClientFromAllRooms(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	ankur := &memSession{name: "ankur"}
+	anand := &memSession{name: "anand"}
+	must(t, ds.registerClient("ankur", ankur))
+	must(t, ds.registerClient("anand", anand))
+	ds.setNotify("ankur", false)
+	ds.addClientToRoom("anand", "roomname")
+	ds.addClientToRoom("anand", "roomnamenew")
+	ds.addClientToRoom("ankur", "roomnamenew")
+
+	ds.deleteClient("anand")
+	expected := []roomInfo{{Name: metaRoom, Members: 1}, {Name: "roomnamenew", Members: 1}}
+	if rooms := ds.listRooms(); !reflect.DeepEqual(rooms, expected) {
+		t.Errorf("expected rooms %v got %v", expected, rooms)
+	}
+	for _, room := range []roomID{metaRoom, "roomnamenew"} {
+		ds.broadcastMsg(context.Background(), newChatMessage("ankur", string(room), "hi there", originTelnet))
+	}
+	time.Sleep(time.Millisecond * 10)
+	if msgs := anand.messages(); len(msgs) != 0 {
+		t.Errorf("expected deleted client to receive no message got %d", len(msgs))
+	}
+
+	// the name can be registered again once deleted.
+	must(t, ds.registerClient("anand", &memSession{name: "anand"}))
+
+	// the meta room is kept even when empty.
+	ds.deleteClient("ankur")
+	ds.deleteClient("anand")
+	expected = []roomInfo{{Name: metaRoom, Members: 0}}
+	if rooms := ds.listRooms(); !reflect.DeepEqual(rooms, expected) {
+		t.Errorf("expected rooms %v got %v", expected, rooms)
+	}
+}
+
+func TestClientChurn(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprintf("test%d-%d", i, j)
+				room := fmt.Sprintf("room%d", j%5)
+				if err := ds.registerClient(name, &memSession{name: name}); err != nil {
+					t.Errorf("expected nil err got %v", err)
+					return
+				}
+				ds.addClientToRoom(name, room)
+				ds.broadcastMsg(context.Background(), newChatMessage(name, room, "hi there", originTelnet))
+				ds.listRooms()
+				if j%2 == 0 {
+					ds.removeClientFromRoom(name, room)
+				}
+				ds.deleteClient(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	if len(ds.clients) != 0 {
+		t.Errorf("expected no client left got %d", len(ds.clients))
+	}
+	if len(ds.roomsSubscribers) != 1 || len(ds.roomsSubscribers[metaRoom]) != 0 {
+		t.Errorf("expected only the empty meta room left got %v", ds.roomsSubscribers)
+	}
+}
@@ -2,48 +2,126 @@ package pkg
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
-	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // ChatServer holds the chat server application
 type ChatServer struct {
 	telnetHandler  *telnetHandler
 	inShutdown     int32 // accessed atomically (non-zero means we're in Shutdown)
-	telnetListener net.Listener
 	messageIO      *messageIO
 	restAPIHandler *restAPIHandler
-	server         *http.Server
+	tlsConfig      *tls.Config // nil if no certificate is configured.
+	sshHandler     *sshHandler // nil if no ssh host key is configured.
+
+	lock      sync.Mutex // guards the below listeners and servers.
+	listeners []net.Listener
+	servers   []*http.Server
 }
 
+var errNoCertificate = errors.New("tls_cert_file and tls_key_file are not configured")
+
+// shutdownDrainTime is the part of the shutdown deadline kept to drain and close the connections,
+// the clients are given the rest of it to leave.
+const shutdownDrainTime = time.Second
+
 // NewChatServer returns an initialized ChatServer
-func NewChatServer(filePath string) (*ChatServer, error) {
-	fd, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+func NewChatServer(cfg Config) (*ChatServer, error) {
+	policy, err := parseOverflowPolicy(cfg.OverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	mIo, err := openMessageIO(cfg.LogFile, cfg.rotationPolicy())
+	if err != nil {
+		return nil, err
+	}
+	rooms, err := openRoomMetaStore(cfg.RoomsFile)
 	if err != nil {
 		return nil, err
 	}
-	readfd, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	cStore := newChatDataStoreWithQueue(ioutil.Discard, queueConfig{size: cfg.OutboundQueueSize, policy: policy}, rooms)
+	users, err := openUserStore(cfg.UsersFile)
 	if err != nil {
 		return nil, err
 	}
-	mIo := newMessageIO(fd, readfd)
-	cStore := newChatDataStore(ioutil.Discard)
-	return &ChatServer{telnetHandler: newTelnetHFromChatStore(mIo, cStore), messageIO: mIo, restAPIHandler: newRestAPIHandler(mIo, cStore)}, nil
+	// the roles of the names not registered are left over from the clients that didn't
+	// leave before the server stopped, the names are free now.
+	cStore.releaseRoomRoles(func(cid clientID) bool {
+		return !users.isRegistered(string(cid))
+	})
+	tokens, err := openTokenStore(cfg.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	th := newTelnetHFromChatStore(mIo, cStore, mIo, cfg.HistorySize, users)
+	rh := newRestAPIHandlerWithTokens(mIo, cStore, tokens, cfg.AdminToken)
+	// websocket clients share the same command loop and chat store as the telnet clients.
+	rh.mux.Handle("/ws", newWebSocketHandler(th))
+	cs := &ChatServer{telnetHandler: th, messageIO: mIo, restAPIHandler: rh, tlsConfig: tlsConfig}
+	// and so do the ssh clients.
+	if cfg.SSHHostKeyFile != "" {
+		hostKey, err := loadHostKey(cfg.SSHHostKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cs.sshHandler = newSSHHandler(th, hostKey, cfg.SSHAuthorizedKeysFile)
+	}
+	return cs, nil
 }
 
 // ServeHTTP Serves the Rest HTTP API Call.
 func (cs *ChatServer) ServeHTTP(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("http server starting on address: %s", addr)
+	cs.serveHTTPListener(l, nil)
+}
+
+// ServeHTTPS Serves the Rest HTTP API Call over TLS, with the configured certificate.
+func (cs *ChatServer) ServeHTTPS(addr string) {
+	if cs.tlsConfig == nil {
+		panic(errNoCertificate)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("https server starting on address: %s", addr)
+	cs.serveHTTPListener(l, cs.tlsConfig)
+}
+
+// serveHTTPListener serves the Rest HTTP API on the listener until shutdown,
+// over TLS if tlsConfig is not nil.
+func (cs *ChatServer) serveHTTPListener(l net.Listener, tlsConfig *tls.Config) {
 	server := &http.Server{}
-	server.Addr = addr
+	server.Addr = l.Addr().String()
 	server.Handler = cs.restAPIHandler
-	cs.server = server
-	log.Printf("http server starting on address: %s", addr)
-	err := server.ListenAndServe()
+	cs.lock.Lock()
+	cs.servers = append(cs.servers, server)
+	cs.lock.Unlock()
+	var err error
+	if tlsConfig != nil {
+		server.TLSConfig = tlsConfig.Clone()
+		err = server.ServeTLS(l, "", "")
+	} else {
+		err = server.Serve(l)
+	}
 	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
@@ -55,9 +133,48 @@ func (cs *ChatServer) ServeTelnet(addr string) {
 	if err != nil {
 		panic(fmt.Sprintf("unable to listen to chat address, error: %s", err))
 	}
-	defer l.Close()
 	log.Printf("telnet chat server started on address: %s", addr)
-	cs.telnetListener = l
+	cs.serveTelnetListener(l)
+}
+
+// ServeTelnetTLS responds to the telnet request over TLS, with the configured certificate.
+// The clients connect with a TLS capable client like `openssl s_client`.
+func (cs *ChatServer) ServeTelnetTLS(addr string) {
+	if cs.tlsConfig == nil {
+		panic(errNoCertificate)
+	}
+	l, err := tls.Listen("tcp", addr, cs.tlsConfig)
+	if err != nil {
+		panic(fmt.Sprintf("unable to listen to chat tls address, error: %s", err))
+	}
+	log.Printf("telnet tls chat server started on address: %s", addr)
+	cs.serveTelnetListener(l)
+}
+
+// ServeSSH responds to the ssh request, the clients authenticated by public key chat with their user name.
+func (cs *ChatServer) ServeSSH(addr string) {
+	if cs.sshHandler == nil {
+		panic(errNoSSHHostKey)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(fmt.Sprintf("unable to listen to ssh address, error: %s", err))
+	}
+	log.Printf("ssh chat server started on address: %s", addr)
+	cs.serveListener(l, cs.sshHandler.serveConn)
+}
+
+// serveTelnetListener accepts the telnet connections on the listener until it is closed.
+func (cs *ChatServer) serveTelnetListener(l net.Listener) {
+	cs.serveListener(l, cs.telnetHandler.serveConn)
+}
+
+// serveListener accepts the connections on the listener until it is closed, each served by serve.
+func (cs *ChatServer) serveListener(l net.Listener, serve func(conn net.Conn)) {
+	defer l.Close()
+	cs.lock.Lock()
+	cs.listeners = append(cs.listeners, l)
+	cs.lock.Unlock()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -83,31 +200,88 @@ func (cs *ChatServer) ServeTelnet(addr string) {
 			}
 			return
 		}
-		go cs.telnetHandler.serveConn(conn)
+		go serve(conn)
 	}
 }
 
-// Shutdown tries to gracefully shuts down the chat server
-func (cs *ChatServer) Shutdown() {
+// Shutdown gracefully shuts down the chat server.
+// It stops accepting new connections, notifies every room of the grace period, and lets the clients
+// chat until the grace period ends or they all leave. It then waits for the pending outbound
+// messages of every client and the message log to be flushed, and closes all the connections.
+// The grace period is the time left until the ctx deadline, but the drain time.
+// If the ctx expires before the connections are drained, they are closed anyway and the ctx
+// error is returned.
+func (cs *ChatServer) Shutdown(ctx context.Context) error {
 	atomic.StoreInt32(&cs.inShutdown, 1)
-	err := cs.telnetListener.Close()
-	if err != nil {
-		log.Printf("unable to close listener conn, err: %v \n", err)
+	cs.lock.Lock()
+	listeners, servers := cs.listeners, cs.servers
+	cs.lock.Unlock()
+	for _, l := range listeners {
+		err := l.Close()
+		if err != nil {
+			log.Printf("unable to close listener conn, err: %v \n", err)
+		}
+	}
+	// http server Shutdown stops accepting right away, and then waits for the
+	// active streams which ends once all the sessions are closed below.
+	httpDone := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			httpDone <- server.Shutdown(ctx)
+		}(server)
+	}
+
+	store := cs.telnetHandler.chatStore
+	grace := shutdownGrace(ctx)
+	store.announce(shutdownNotice(grace))
+	store.waitClientsLeft(ctx, grace)
+	drainErr := store.flushAll(ctx)
+	if drainErr != nil {
+		log.Printf("unable to drain the outbound messages, err: %v \n", drainErr)
 	}
-	cs.telnetHandler.chatStore.closeAllConn()
-	err = cs.messageIO.Sync()
+	err := cs.messageIO.Sync()
 	if err != nil {
 		log.Printf("err sync message logs, err: %v \n", err)
 	}
+	store.closeAllConn()
+	err = store.rooms.sync()
+	if err != nil {
+		log.Printf("err saving the rooms metadata, err: %v \n", err)
+	}
 	err = cs.messageIO.Close()
 	if err != nil {
 		log.Printf("err closing fd logs, err: %v \n", err)
 	}
 
-	err = cs.server.Shutdown(context.Background())
-	if err != nil {
-		log.Printf("err closing http Server, err: %v \n", err)
+	for range servers {
+		err = <-httpDone
+		if err != nil {
+			log.Printf("err closing http Server, err: %v \n", err)
+		}
+	}
+	if drainErr != nil {
+		return fmt.Errorf("shutdown deadline exceeded before draining connections: %w", drainErr)
+	}
+	return ctx.Err()
+}
+
+// shutdownGrace returns the time the clients are given to leave on shutdown, the time left
+// until the ctx deadline but the drain time. There is none without a deadline.
+func shutdownGrace(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	grace := time.Until(deadline) - shutdownDrainTime
+	if grace < 0 {
+		return 0
 	}
+	return grace
+}
+
+// shutdownNotice returns the notice sent to every room on shutdown.
+func shutdownNotice(grace time.Duration) string {
+	return fmt.Sprintf("server shutting down in %d seconds", int(math.Ceil(grace.Seconds())))
 }
 
 func (cs *ChatServer) shuttingDown() bool {
@@ -0,0 +1,267 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestChatServer(t *testing.T) *ChatServer {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	cs, err := NewChatServer(Config{LogFile: filepath.Join(dir, "telchat.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+// dialTelnet starts the telnet listener of the chat server and connects a client with the given name.
+func dialTelnet(t *testing.T, cs *ChatServer, name string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cs.serveTelnetListener(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	must(t, conn.SetDeadline(time.Now().Add(time.Second*2)))
+	_, err = conn.Write([]byte(name + "\r\n"))
+	must(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+// readUntil reads lines from r until one contains sub.
+func readUntil(t *testing.T, r *bufio.Reader, sub string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if strings.Contains(line, sub) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("expected %q before err: %v", sub, err)
+		}
+	}
+}
+
+func TestChatServerShutdown(t *testing.T) {
+	t.Parallel()
+	cs := newTestChatServer(t)
+	conn, r := dialTelnet(t, cs, "ankur")
+	defer conn.Close()
+	readUntil(t, r, "[default]")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2+shutdownDrainTime)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- cs.Shutdown(ctx)
+	}()
+	readUntil(t, r, "server shutting down in 2 seconds")
+	start := time.Now()
+	must(t, conn.SetDeadline(start.Add(time.Second*5)))
+	// the client can still chat during the grace period.
+	_, err := conn.Write([]byte("bye\r\n"))
+	must(t, err)
+	for err == nil {
+		_, err = r.ReadString('\n')
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected conn to be closed after shutdown")
+	}
+	if d := time.Since(start); d < time.Second*3/2 {
+		t.Errorf("expected conn to be closed after the grace period got %v", d)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected nil shutdown err got %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout waiting for shutdown")
+	}
+}
+
+func TestChatServerShutdownClientsLeft(t *testing.T) {
+	t.Parallel()
+	cs := newTestChatServer(t)
+	conn, r := dialTelnet(t, cs, "ankur")
+	readUntil(t, r, "[default]")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- cs.Shutdown(ctx)
+	}()
+	readUntil(t, r, "server shutting down in 9 seconds")
+	must(t, conn.Close())
+	// the grace period ends once every client has left.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected nil shutdown err got %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout waiting for shutdown")
+	}
+}
+
+func TestChatServerShutdownDeadlineExceeded(t *testing.T) {
+	t.Parallel()
+	cs := newTestChatServer(t)
+	slow := newGatedSession("slow")
+	defer close(slow.gate)
+	must(t, cs.telnetHandler.chatStore.registerClient("slow", slow))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := cs.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded err got %v", err)
+	}
+	slow.lock.Lock()
+	closed := slow.closed
+	slow.lock.Unlock()
+	if !closed {
+		t.Error("expected slow session to be closed after the deadline")
+	}
+}
+
+// writeSelfSignedCert writes a self-signed certificate of 127.0.0.1 and its key in dir,
+// it returns their files and the pool trusting the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "telchat"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	must(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	must(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestChatServerTLS(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, pool := writeSelfSignedCert(t, dir)
+
+	_, err = NewChatServer(Config{LogFile: filepath.Join(dir, "telchat.log"), TLSCertFile: certFile})
+	if err == nil {
+		t.Error("expected err for the certificate without key")
+	}
+	cs, err := NewChatServer(Config{LogFile: filepath.Join(dir, "telchat.log"), TLSCertFile: certFile, TLSKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the telnet clients chat over TLS.
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cs.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cs.serveTelnetListener(l)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	must(t, conn.SetDeadline(time.Now().Add(time.Second*2)))
+	_, err = conn.Write([]byte("ankur\r\n"))
+	must(t, err)
+	r := bufio.NewReader(conn)
+	readUntil(t, r, "[default]")
+	_, err = conn.Write([]byte("/room who\r\n"))
+	must(t, err)
+	readUntil(t, r, "ankur")
+
+	// and the REST API is served over HTTPS.
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cs.serveHTTPListener(hl, cs.tlsConfig)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	res, err := client.Get("https://" + hl.Addr().String() + "/rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 got %d", res.StatusCode)
+	}
+	// the plain text clients are refused by the TLS listener.
+	plain, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	must(t, plain.SetDeadline(time.Now().Add(time.Second*2)))
+	_, err = plain.Write([]byte("ankur\r\n"))
+	must(t, err)
+	if b, _ := ioutil.ReadAll(plain); strings.Contains(string(b), "Welcome") {
+		t.Error("expected no welcome message over plain text")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	must(t, cs.Shutdown(ctx))
+	if _, err := client.Get("https://" + hl.Addr().String() + "/rooms"); err == nil {
+		t.Error("expected the https server to be closed after shutdown")
+	}
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+)
+
+// Config holds the configuration of the chat server.
+type Config struct {
+	// LogFile is the location of the file where messages are persisted.
+	LogFile string `json:"log_file"`
+	// TelnetAddr is the telnet chat server address "ip:port".
+	TelnetAddr string `json:"telnet_addr"`
+	// HTTPAddr is the rest api server address "ip:port".
+	HTTPAddr string `json:"http_addr"`
+	// HistorySize is the number of previous room messages replayed to a client
+	// when it joins a room, zero disables the replay.
+	HistorySize int `json:"history_size"`
+	// OutboundQueueSize is the number of messages queued for each client
+	// before the overflow policy applies.
+	OutboundQueueSize int `json:"outbound_queue_size"`
+	// OverflowPolicy is one of "drop_oldest", "drop_newest" or "disconnect".
+	OverflowPolicy string `json:"overflow_policy"`
+	// ShutdownTimeout is the number of seconds given to drain the connections on shutdown.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// LogMaxSizeMB rotates the log file once it grows past the size in megabytes.
+	LogMaxSizeMB int `json:"log_max_size_mb"`
+	// LogMaxAgeHours rotates the log file once it has been written for the hours.
+	LogMaxAgeHours int `json:"log_max_age_hours"`
+	// LogMaxSegments is the number of rotated log files to keep.
+	LogMaxSegments int `json:"log_max_segments"`
+	// LogMaxDays is the number of days the rotated log files are kept.
+	LogMaxDays int `json:"log_max_days"`
+	// LogCompress gzip the rotated log files.
+	LogCompress bool `json:"log_compress"`
+	// RoomsFile is the location of the file where the rooms metadata is persisted.
+	RoomsFile string `json:"rooms_file"`
+	// UsersFile is the location of the file where the registered accounts are persisted.
+	UsersFile string `json:"users_file"`
+	// TokensFile is the location of the file where the REST API tokens are persisted.
+	TokensFile string `json:"tokens_file"`
+	// AdminToken is the bearer token of the REST admin endpoints, empty disables them.
+	AdminToken string `json:"admin_token"`
+	// TelnetTLSAddr is the TLS encrypted telnet chat server address "ip:port", empty disables it.
+	TelnetTLSAddr string `json:"telnet_tls_addr"`
+	// HTTPSAddr is the HTTPS rest api server address "ip:port", empty disables it.
+	HTTPSAddr string `json:"https_addr"`
+	// TLSCertFile and TLSKeyFile are the locations of the PEM encoded certificate
+	// and private key of the TLS listeners.
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// SSHAddr is the ssh chat server address "ip:port", empty disables it.
+	SSHAddr string `json:"ssh_addr"`
+	// SSHHostKeyFile is the location of the PEM encoded ssh host key, generated if missing.
+	SSHHostKeyFile string `json:"ssh_host_key_file"`
+	// SSHAuthorizedKeysFile is the location of the authorized_keys file of the ssh clients,
+	// the comment of each key is the user name, and chat name, it authenticates.
+	SSHAuthorizedKeysFile string `json:"ssh_authorized_keys_file"`
+}
+
+// rotationPolicy returns the message log rotation policy of the config.
+func (c Config) rotationPolicy() rotationPolicy {
+	return rotationPolicy{
+		maxSize:     int64(c.LogMaxSizeMB) << 20,
+		maxAge:      time.Duration(c.LogMaxAgeHours) * time.Hour,
+		maxSegments: c.LogMaxSegments,
+		maxDays:     c.LogMaxDays,
+		compress:    c.LogCompress,
+	}
+}
+
+// tlsConfig returns the TLS config of the certificate and key of the config,
+// nil if none is configured.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("both tls_cert_file and tls_key_file must be configured")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
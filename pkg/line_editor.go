@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxLineHistory is the number of previous lines kept for the up-arrow recall.
+const maxLineHistory = 50
+
+// terminal keys handled by the line editor.
+const (
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyBackspace = 0x08
+	keyCtrlU     = 0x15
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// escape sequence parse states of the line editor.
+const (
+	escNone = iota
+	escStart
+	escCSI
+)
+
+// lineEditor edits the input line of a client in character mode, where the server
+// echoes the typed keys. It supports backspace, Ctrl-U to erase the line, and the
+// up and down arrows to recall the previous lines.
+type lineEditor struct {
+	buf []byte
+	// masked input is not echoed nor recalled, like a password.
+	masked  bool
+	history []string
+	// hpos is the position of the recalled line in the history, len(history) when none.
+	hpos int
+	esc  int
+	cr   bool
+	// cols is the width of the client window, zero if unknown.
+	cols int
+}
+
+// feed edits the line with the typed byte c. It returns the echo to write back
+// to the client, and the line once entered.
+func (le *lineEditor) feed(c byte, r renderer) (echo string, line string, entered bool) {
+	if le.esc != escNone {
+		return le.feedEscape(c, r), "", false
+	}
+	// CR LF and CR NUL are a single enter.
+	if le.cr && (c == '\n' || c == 0) {
+		le.cr = false
+		return "", "", false
+	}
+	le.cr = c == '\r'
+	switch {
+	case c == '\r' || c == '\n':
+		line = string(le.buf)
+		if !le.masked {
+			echo = "\r\n"
+			if line != "" && (len(le.history) == 0 || le.history[len(le.history)-1] != line) {
+				le.history = append(le.history, line)
+				if len(le.history) > maxLineHistory {
+					le.history = le.history[1:]
+				}
+			}
+		}
+		le.buf = le.buf[:0]
+		le.hpos = len(le.history)
+		return echo, line, true
+	case c == keyBackspace || c == keyDelete:
+		if len(le.buf) == 0 {
+			return "", "", false
+		}
+		_, size := utf8.DecodeLastRune(le.buf)
+		le.buf = le.buf[:len(le.buf)-size]
+		if le.masked {
+			return "", "", false
+		}
+		return "\b \b", "", false
+	case c == keyCtrlU:
+		echo = le.erase(r)
+		le.buf = le.buf[:0]
+		return echo, "", false
+	case c == keyEscape:
+		le.esc = escStart
+		return "", "", false
+	case c < ' ':
+		// the other control keys are ignored.
+		return "", "", false
+	}
+	le.buf = append(le.buf, c)
+	if le.masked {
+		return "", "", false
+	}
+	return string([]byte{c}), "", false
+}
+
+// feedEscape handles the escape sequences, only the up and down arrows are supported.
+func (le *lineEditor) feedEscape(c byte, r renderer) string {
+	switch le.esc {
+	case escStart:
+		// ESC [ and ESC O both start the arrow keys.
+		if c == '[' || c == 'O' {
+			le.esc = escCSI
+			return ""
+		}
+		le.esc = escNone
+		return ""
+	}
+	// the parameters of the sequence are skipped until its final byte.
+	if c >= 0x30 && c <= 0x3f {
+		return ""
+	}
+	le.esc = escNone
+	if le.masked {
+		return ""
+	}
+	switch c {
+	case 'A':
+		if le.hpos == 0 {
+			return ""
+		}
+		le.hpos--
+	case 'B':
+		if le.hpos >= len(le.history) {
+			return ""
+		}
+		le.hpos++
+	default:
+		return ""
+	}
+	echo := le.erase(r)
+	le.buf = le.buf[:0]
+	if le.hpos < len(le.history) {
+		le.buf = append(le.buf, le.history[le.hpos]...)
+	}
+	return echo + string(le.buf)
+}
+
+// erase returns the output erasing the typed line from the client screen.
+func (le *lineEditor) erase(r renderer) string {
+	if le.masked {
+		return ""
+	}
+	return r.eraseLine(utf8.RuneCount(le.buf), le.cols)
+}
+
+// redraw returns the output erasing the typed line, the text written to the client in
+// place of it, and the typed line again below the text.
+func (le *lineEditor) redraw(text string, r renderer) string {
+	if len(le.buf) == 0 || le.masked {
+		return text
+	}
+	var b strings.Builder
+	b.WriteString(le.erase(r))
+	b.WriteString(text)
+	// the text may end with a bare new line.
+	b.WriteString("\r")
+	b.Write(le.buf)
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineEditorFeed(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name   string
+		masked bool
+		in     string
+		echo   string
+		lines  []string
+	}{
+		{name: "typing", in: "hi\r\n", echo: "hi\r\n", lines: []string{"hi"}},
+		{name: "carriage return", in: "hi\r\x00yo\n", echo: "hi\r\nyo\r\n", lines: []string{"hi", "yo"}},
+		{name: "backspace", in: "hix\x7f\x08\x08\r", echo: "hix\b \b\b \b\b \b\r\n", lines: []string{""}},
+		{name: "backspace utf-8", in: "né\x7f\r", echo: "né\b \b\r\n", lines: []string{"n"}},
+		{name: "erase line", in: "hi\x15yo\r", echo: "hi\r\033[Kyo\r\n", lines: []string{"yo"}},
+		{name: "control keys", in: "h\x01i\r", echo: "hi\r\n", lines: []string{"hi"}},
+		{name: "history", in: "a\rb\r\x1b[A\x1b[A\x1b[A\x1b[B\r", echo: "a\r\nb\r\n\r\033[Kb\r\033[Ka\r\033[Kb\r\n", lines: []string{"a", "b", "b"}},
+		{name: "history back to empty", in: "a\r\x1bOA\x1bOB\x1b[B\r", echo: "a\r\n\r\033[Ka\r\033[K\r\n", lines: []string{"a", ""}},
+		{name: "unknown escape", in: "a\x1b[1;5C\x1bxb\r", echo: "ab\r\n", lines: []string{"ab"}},
+		{name: "masked", masked: true, in: "s3\x7fcret\x1b[A\r", lines: []string{"scret"}},
+	}
+	for _, tc := range tcs {
+		le := lineEditor{masked: tc.masked}
+		var echo string
+		var lines []string
+		for i := 0; i < len(tc.in); i++ {
+			e, line, entered := le.feed(tc.in[i], ansiRenderer{})
+			echo += e
+			if entered {
+				lines = append(lines, line)
+			}
+		}
+		if echo != tc.echo {
+			t.Errorf("%s: expected echo %q got %q", tc.name, tc.echo, echo)
+		}
+		if !reflect.DeepEqual(lines, tc.lines) {
+			t.Errorf("%s: expected lines %q got %q", tc.name, tc.lines, lines)
+		}
+	}
+
+	// the masked lines are not recalled, nor the consecutive duplicates.
+	le := lineEditor{}
+	for _, in := range []string{"a\r", "a\r", "b\r"} {
+		for i := 0; i < len(in); i++ {
+			le.feed(in[i], ansiRenderer{})
+		}
+	}
+	le.masked = true
+	le.feed('x', ansiRenderer{})
+	le.feed('\r', ansiRenderer{})
+	if !reflect.DeepEqual(le.history, []string{"a", "b"}) {
+		t.Errorf("expected history [a b] got %q", le.history)
+	}
+}
+
+func TestLineEditorRedraw(t *testing.T) {
+	t.Parallel()
+	le := lineEditor{}
+	if out := le.redraw("msg\n\r", plainRenderer{}); out != "msg\n\r" {
+		t.Errorf("expected the text as is without a typed line got %q", out)
+	}
+	le.buf = append(le.buf, "hel"...)
+	if out := le.redraw("msg\n\r", plainRenderer{}); out != "\r   \rmsg\n\r\rhel" {
+		t.Errorf("expected the typed line below the text got %q", out)
+	}
+	// the line wrapped over the rows of the window is erased from its first row.
+	le.cols = 2
+	if out := le.redraw("msg\n\r", ansiRenderer{}); out != "\033[1A\r\033[Jmsg\n\r\rhel" {
+		t.Errorf("expected the wrapped line erased got %q", out)
+	}
+	if out := le.redraw("msg\n\r", plainRenderer{}); out != "\r \rmsg\n\r\rhel" {
+		t.Errorf("expected the last row of the wrapped line erased got %q", out)
+	}
+	le.masked = true
+	if out := le.redraw("msg\n\r", plainRenderer{}); out != "msg\n\r" {
+		t.Errorf("expected the masked line not redrawn got %q", out)
+	}
+}
@@ -1,73 +1,407 @@
 package pkg
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
+	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// messageKind identifies the kind of the message, empty kind is a chat message.
+type messageKind string
+
+const (
+	// kindSystem are the notices from the chat server itself.
+	kindSystem messageKind = "system"
+	// kindDirect are the private messages to a single recipient.
+	kindDirect messageKind = "dm"
+)
+
+// messageOrigin identifies the transport a message was received on.
+type messageOrigin string
+
+const (
+	originTelnet    messageOrigin = "telnet"
+	originREST      messageOrigin = "rest"
+	originWebSocket messageOrigin = "websocket"
+	originSSH       messageOrigin = "ssh"
+
+	// maxRecordSize is the largest single encoded message record we are willing to decode.
+	maxRecordSize = 1 << 20
+)
+
+// chatMessage is a single persisted chat message record.
+type chatMessage struct {
+	ID        string        `json:"id"`
+	Sender    clientID      `json:"sender"`
+	Room      roomID        `json:"room"`
+	Timestamp time.Time     `json:"timestamp"`
+	Body      string        `json:"body"`
+	Origin    messageOrigin `json:"origin"`
+	Kind      messageKind   `json:"kind,omitempty"`
+	// Recipient of the private message.
+	Recipient clientID `json:"recipient,omitempty"`
+}
+
+// newChatMessage returns a new message record stamped with a fresh id and the current UTC time.
+func newChatMessage(sender, room, body string, origin messageOrigin) chatMessage {
+	return chatMessage{
+		ID:        newMessageID(),
+		Sender:    clientID(sender),
+		Room:      roomID(room),
+		Timestamp: time.Now().UTC(),
+		Body:      body,
+		Origin:    origin,
+	}
+}
+
+// newDirectMessage returns a new private message record from the sender to the recipient.
+func newDirectMessage(sender, recipient, body string, origin messageOrigin) chatMessage {
+	m := newChatMessage(sender, "", body, origin)
+	m.Kind = kindDirect
+	m.Recipient = clientID(recipient)
+	return m
+}
+
+// newSystemMessage returns a new system notice to the room.
+func newSystemMessage(room, body string) chatMessage {
+	return chatMessage{
+		ID:        newMessageID(),
+		Room:      roomID(room),
+		Timestamp: time.Now().UTC(),
+		Body:      body,
+		Kind:      kindSystem,
+	}
+}
+
+// newMessageID returns a random hex encoded message id.
+func newMessageID() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		// fallback to the clock, ids only need to be unique within the log.
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeMessage encodes the message as a single JSON line to w.
+func writeMessage(w io.Writer, m chatMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// decodeMessages decodes the JSON lines message records from r and calls fn
+// for each one of them in order, until fn returns false.
+// Lines that are not valid records are skipped.
+func decodeMessages(r io.Reader, fn func(m chatMessage) bool) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), maxRecordSize)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var m chatMessage
+		if err := json.Unmarshal(line, &m); err != nil {
+			log.Printf("skipping undecodable message record, err: %v\n", err)
+			continue
+		}
+		if !fn(m) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// historyReader reads back the latest persisted messages of a room.
+type historyReader interface {
+	lastMessages(room roomID, n int) ([]chatMessage, error)
+}
+
+var errMessageIOClosed = errors.New("message io closed")
+
 // messageIO logs the messages to local log file.
 type messageIO struct {
 	mBuffer   chan []byte
-	syCh      chan struct{}
+	syCh      chan chan error // each sync request is replied once the buffer is written and fsynced.
+	done      chan struct{}   // closed on Close to stop the batch writer.
+	exited    chan struct{}   // closed once the batch writer has exited.
+	state     sync.RWMutex    // guards closed against in flight Write and Sync.
+	closed    bool
 	file      *os.File
 	lock      sync.Mutex // support concurrent read
 	readFiled *os.File   // to support concurrent read and write op's to the same underlying file.
+	// path of the active segment, rotated segments are stored next to it.
+	path   string
+	policy rotationPolicy
+	// size and opened of the active segment, accessed only by the batch writer.
+	size   int64
+	opened time.Time
+	// errHandler is called with every error of the batch writer, as it has no caller to return them to.
+	errHandler func(err error)
+	// compressing tracks the rotated segments being compressed in the background.
+	compressing sync.WaitGroup
 }
 
 // Write to the message buffer.
 func (m *messageIO) Write(p []byte) (n int, err error) {
+	m.state.RLock()
+	defer m.state.RUnlock()
+	if m.closed {
+		return 0, errMessageIOClosed
+	}
 	m.mBuffer <- p
 	return len(p), nil
 }
 
-// ReadAll Content of a file.
+// ReadAll Content of all the log file segments, oldest first.
 func (m *messageIO) ReadAll() ([]byte, error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	// flush write
-	// err := m.file.Sync()
-	// if err != nil {
-	// 	return nil, err
-	// }
-	_, err := m.readFiled.Seek(0, io.SeekStart)
+	buffer := new(bytes.Buffer)
+	err := m.forEachSegment(time.Time{}, func(r io.Reader) (bool, error) {
+		_, err := buffer.ReadFrom(r)
+		return true, err
+	})
 	if err != nil {
 		return nil, err
 	}
-	fileinfo, err := m.readFiled.Stat()
+	return buffer.Bytes(), nil
+}
+
+// scanMessages decodes every message record persisted in the log file segments, but the
+// ones rotated before since, and calls fn for each one of them in order, until fn returns false.
+func (m *messageIO) scanMessages(since time.Time, fn func(msg chatMessage) bool) error {
+	return m.forEachSegment(since, func(r io.Reader) (bool, error) {
+		more := true
+		err := decodeMessages(r, func(msg chatMessage) bool {
+			more = fn(msg)
+			return more
+		})
+		return more, err
+	})
+}
+
+// readMessages returns every message record persisted in the log file.
+func (m *messageIO) readMessages() ([]chatMessage, error) {
+	var msgs []chatMessage
+	err := m.scanMessages(time.Time{}, func(msg chatMessage) bool {
+		msgs = append(msgs, msg)
+		return true
+	})
+	return msgs, err
+}
+
+// messageQuery filters the persisted messages.
+// zero valued fields don't filter.
+type messageQuery struct {
+	room   roomID
+	sender clientID
+	since  time.Time
+	until  time.Time
+	// cursor is the timestamp and id of the last message of the previous page.
+	cursor string
+	limit  int
+	// readable filters the rooms the caller can read, nil matches every room.
+	readable func(roomID) bool
+}
+
+// match returns true if the message satisfies the query filters.
+// private messages never match.
+func (q messageQuery) match(m chatMessage) bool {
+	if m.Kind == kindDirect {
+		return false
+	}
+	if q.room != "" && m.Room != q.room {
+		return false
+	}
+	if q.readable != nil && !q.readable(m.Room) {
+		return false
+	}
+	if q.sender != "" && m.Sender != q.sender {
+		return false
+	}
+	if !q.since.IsZero() && m.Timestamp.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && m.Timestamp.After(q.until) {
+		return false
+	}
+	return true
+}
+
+// queryMessages returns a single page of at most q.limit messages matching the query, oldest first,
+// along with the cursor of the next page. The cursor is empty when there are no more pages.
+func (m *messageIO) queryMessages(q messageQuery) ([]chatMessage, string, error) {
+	msgs := make([]chatMessage, 0)
+	var next string
+	// seek past the cursor, if any.
+	afterCursor := q.cursor == ""
+	since := q.since
+	var cursorID string
+	if !afterCursor {
+		var cursorTime time.Time
+		var ok bool
+		cursorTime, cursorID, ok = parseCursor(q.cursor)
+		if !ok {
+			return nil, "", errInvalidCursor
+		}
+		if cursorTime.After(since) {
+			since = cursorTime
+		}
+	}
+	err := m.scanMessages(since, func(msg chatMessage) bool {
+		if !afterCursor {
+			afterCursor = msg.ID == cursorID
+			return true
+		}
+		if !q.match(msg) {
+			return true
+		}
+		if len(msgs) == q.limit {
+			next = formatCursor(msgs[len(msgs)-1])
+			return false
+		}
+		msgs = append(msgs, msg)
+		return true
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if !afterCursor {
+		return nil, "", errInvalidCursor
 	}
-	filesize := fileinfo.Size()
-	buffer := make([]byte, filesize)
+	return msgs, next, nil
+}
 
-	_, err = m.readFiled.Read(buffer)
-	if err != nil && err != io.EOF {
-		return nil, err
+// formatCursor returns the cursor of the page following the message.
+// It carries the message timestamp, so the segments rotated before it are not read again.
+func formatCursor(msg chatMessage) string {
+	return strconv.FormatInt(msg.Timestamp.UnixNano(), 10) + "-" + msg.ID
+}
+
+// parseCursor returns the message timestamp and id of the cursor.
+func parseCursor(cursor string) (time.Time, string, bool) {
+	i := strings.IndexByte(cursor, '-')
+	if i < 0 {
+		return time.Time{}, "", false
 	}
-	return buffer, nil
+	ns, err := strconv.ParseInt(cursor[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, ns).UTC(), cursor[i+1:], true
+}
+
+// lastMessages returns at most n of the latest messages persisted for the given room, oldest first.
+// The segments are read newest first, until n messages are found.
+func (m *messageIO) lastMessages(room roomID, n int) ([]chatMessage, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	var last []chatMessage
+	err := m.forEachSegmentNewest(func(r io.Reader) (bool, error) {
+		// the latest messages of an older segment go before the ones already found.
+		ring := make([]chatMessage, 0, n-len(last))
+		err := decodeMessages(r, func(msg chatMessage) bool {
+			if msg.Room != room {
+				return true
+			}
+			if len(ring) == cap(ring) {
+				ring = append(ring[:0], ring[1:]...)
+			}
+			ring = append(ring, msg)
+			return true
+		})
+		last = append(ring, last...)
+		return len(last) < n, err
+	})
+	return last, err
 }
 
-// Close the underlying file
+// Close flushes the buffered messages, stops the batch writer and closes the underlying file.
+// It is safe to be called multiple times.
 func (m *messageIO) Close() error {
-	err := m.readFiled.Close()
-	err = m.file.Close()
+	m.state.Lock()
+	if m.closed {
+		m.state.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.state.Unlock()
+	close(m.done)
+	<-m.exited
+	m.compressing.Wait()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rerr := m.readFiled.Close()
+	err := m.file.Close()
+	if err == nil {
+		err = rerr
+	}
 	return err
 }
 
+// Sync blocks until every message written before it is written and fsynced to the file.
 func (m *messageIO) Sync() error {
-	m.syCh <- struct{}{}
-	return nil
+	m.state.RLock()
+	defer m.state.RUnlock()
+	if m.closed {
+		return errMessageIOClosed
+	}
+	reply := make(chan error, 1)
+	m.syCh <- reply
+	return <-reply
+}
+
+// writeMessage persist the message record to the log file.
+func (m *messageIO) writeMessage(msg chatMessage) error {
+	return writeMessage(m, msg)
 }
 
 func newMessageIO(file *os.File, readFile *os.File) *messageIO {
+	return newRotatingMessageIO(file, readFile, rotationPolicy{})
+}
+
+// newRotatingMessageIO returns messageIO that rotates the file segments according to the policy.
+func newRotatingMessageIO(file *os.File, readFile *os.File, policy rotationPolicy) *messageIO {
+	var size int64
+	opened := time.Now()
+	if fi, err := file.Stat(); err == nil {
+		size = fi.Size()
+		// the age of the segment appended to carries over the restarts.
+		if size > 0 {
+			opened = segmentOpened(file.Name(), fi.ModTime())
+		}
+	}
 	mio := &messageIO{
+		path:      file.Name(),
+		policy:    policy,
+		size:      size,
+		opened:    opened,
 		file:      file,
 		mBuffer:   make(chan []byte, 100),
-		syCh:      make(chan struct{}),
+		syCh:      make(chan chan error),
+		done:      make(chan struct{}),
+		exited:    make(chan struct{}),
 		readFiled: readFile,
+		errHandler: func(err error) {
+			log.Printf("error writing messages to the log file, err: %v\n", err)
+		},
 	}
 	go batchWriteMessage(mio)
 	return mio
@@ -75,43 +409,70 @@ func newMessageIO(file *os.File, readFile *os.File) *messageIO {
 
 // Write the Message in Batch
 func batchWriteMessage(m *messageIO) {
+	defer close(m.exited)
 	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
 	ticker := time.NewTicker(time.Millisecond * 200)
-	var err error
+	defer ticker.Stop()
+	// flush writes the buffered messages to the file, the messages are dropped on error.
+	flush := func() error {
+		if buffer.Len() == 0 {
+			return nil
+		}
+		err := m.fileWrite(buffer.Bytes())
+		buffer.Reset()
+		if err != nil {
+			m.errHandler(err)
+		}
+		return err
+	}
+	// drain moves all the pending messages to the buffer.
+	drain := func() {
+		for {
+			select {
+			case record := <-m.mBuffer:
+				buffer.Write(record)
+			default:
+				return
+			}
+		}
+	}
+	// syncFile flushes all the pending messages and fsync the file.
+	syncFile := func() error {
+		drain()
+		err := flush()
+		if err != nil {
+			return err
+		}
+		err = m.file.Sync()
+		if err != nil {
+			m.errHandler(err)
+			return err
+		}
+		m.rotateIfNeeded()
+		return nil
+	}
 	for {
 		select {
 		case <-ticker.C:
-			if len(buffer.Bytes()) > 0 {
-				err = m.fileWrite(buffer.Bytes())
-				if err != nil {
-					panic(err)
-				}
-				buffer.Reset()
-			}
-
+			_ = flush()
+			m.rotateIfNeeded()
 		case record := <-m.mBuffer:
 			buffer.Write(record)
-			if len(buffer.Bytes()) >= 1024 {
-				err = m.fileWrite(buffer.Bytes())
-				if err != nil {
-					panic(err)
-				}
-				buffer.Reset()
-			}
-		case <-m.syCh:
-			if len(buffer.Bytes()) > 0 {
-				err = m.fileWrite(buffer.Bytes())
-				if err != nil {
-					panic(err)
-				}
-				buffer.Reset()
+			if buffer.Len() >= 1024 {
+				_ = flush()
+				m.rotateIfNeeded()
 			}
-			break
+		case reply := <-m.syCh:
+			reply <- syncFile()
+		case <-m.done:
+			_ = syncFile()
+			return
 		}
 	}
 }
 
 func (m *messageIO) fileWrite(msg []byte) error {
-	_, err := m.file.Write(msg)
+	n, err := m.file.Write(msg)
+	m.size += int64(n)
 	return err
 }
@@ -0,0 +1,304 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// segmentTimeFormat is the rotation time suffix of the rotated segments, it sorts in time order.
+	segmentTimeFormat = "20060102T150405.000000000"
+	gzipExt           = ".gz"
+)
+
+// rotationPolicy configures when the active log file segment is rotated and how long
+// the rotated segments are retained. zero valued fields disables the option.
+type rotationPolicy struct {
+	// maxSize rotates the active segment once it has grown past maxSize bytes.
+	maxSize int64
+	// maxAge rotates the active segment once it has been open for maxAge.
+	maxAge time.Duration
+	// maxSegments keeps only the latest maxSegments rotated segments.
+	maxSegments int
+	// maxDays removes rotated segments older than maxDays days.
+	maxDays int
+	// compress gzip the rotated segments.
+	compress bool
+}
+
+// openMessageIO opens the log file at path for rotating messageIO.
+func openMessageIO(path string, policy rotationPolicy) (*messageIO, error) {
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	readfd, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	mio := newRotatingMessageIO(fd, readfd, policy)
+	// apply the retention to the segments left over by the previous run.
+	mio.lock.Lock()
+	mio.applyRetention(time.Now())
+	mio.lock.Unlock()
+	return mio, nil
+}
+
+// rotatedSegments returns the path of all the rotated segments of the log file, oldest first.
+func (m *messageIO) rotatedSegments() ([]string, error) {
+	matches, err := filepath.Glob(m.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	segments := matches[:0]
+	for _, name := range matches {
+		if _, ok := segmentTime(m.path, name); ok {
+			segments = append(segments, name)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// segmentTime returns the rotation time of the rotated segment name of the log file at path.
+func segmentTime(path, name string) (time.Time, bool) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), gzipExt)
+	t, err := time.Parse(segmentTimeFormat, suffix)
+	return t, err == nil
+}
+
+// forEachSegment calls fn with the reader of each log file segment, oldest first and the active
+// segment last, until fn returns false or an error. The segments rotated before since are skipped,
+// they hold only older messages.
+func (m *messageIO) forEachSegment(since time.Time, fn func(r io.Reader) (bool, error)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	segments, err := m.rotatedSegments()
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		if t, ok := segmentTime(m.path, name); ok && t.Before(since) {
+			continue
+		}
+		more, err := readSegment(name, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	_, err = fn(m.activeSegment())
+	return err
+}
+
+// forEachSegmentNewest calls fn with the reader of each log file segment, the active segment
+// first and the oldest last, until fn returns false or an error.
+func (m *messageIO) forEachSegmentNewest(fn func(r io.Reader) (bool, error)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	more, err := fn(m.activeSegment())
+	if err != nil || !more {
+		return err
+	}
+	segments, err := m.rotatedSegments()
+	if err != nil {
+		return err
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		more, err := readSegment(segments[i], fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeSegment returns the reader of the active segment from its start.
+// It must be called with the lock held.
+func (m *messageIO) activeSegment() io.Reader {
+	_, err := m.readFiled.Seek(0, io.SeekStart)
+	if err != nil {
+		return errReader{err}
+	}
+	return m.readFiled
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// readSegment calls fn with the reader of the rotated segment, decompressed if needed.
+func readSegment(name string, fn func(r io.Reader) (bool, error)) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if !strings.HasSuffix(name, gzipExt) {
+		return fn(f)
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+	defer gr.Close()
+	return fn(gr)
+}
+
+// segmentOpened returns the time of the first record of the segment at name,
+// or its modTime if it has none.
+func segmentOpened(name string, modTime time.Time) time.Time {
+	opened := modTime
+	_, err := readSegment(name, func(r io.Reader) (bool, error) {
+		return false, decodeMessages(r, func(m chatMessage) bool {
+			if !m.Timestamp.IsZero() {
+				opened = m.Timestamp
+			}
+			return false
+		})
+	})
+	if err != nil {
+		log.Printf("unable to read the first record of %s, err: %v\n", name, err)
+	}
+	return opened
+}
+
+// rotateIfNeeded rotates the active segment if the policy says so.
+// It's called only by the batch writer.
+func (m *messageIO) rotateIfNeeded() {
+	if m.size == 0 {
+		return
+	}
+	now := time.Now()
+	bySize := m.policy.maxSize > 0 && m.size >= m.policy.maxSize
+	byAge := m.policy.maxAge > 0 && now.Sub(m.opened) >= m.policy.maxAge
+	if !bySize && !byAge {
+		return
+	}
+	err := m.rotate(now)
+	if err != nil {
+		m.errHandler(err)
+	}
+}
+
+// rotate renames the active segment to a rotated segment and opens a new active segment.
+func (m *messageIO) rotate(now time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err := m.file.Sync()
+	if err != nil {
+		return err
+	}
+	name := m.path + "." + now.UTC().Format(segmentTimeFormat)
+	err = os.Rename(m.path, name)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	readfd, err := os.OpenFile(m.path, os.O_RDONLY, 0644)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	m.file.Close()
+	m.readFiled.Close()
+	m.file, m.readFiled = fd, readfd
+	m.size, m.opened = 0, now
+
+	if m.policy.compress {
+		// the writes and reads don't wait for the compression.
+		m.compressing.Add(1)
+		go func() {
+			defer m.compressing.Done()
+			err := m.compressSegment(name)
+			if err != nil {
+				m.errHandler(err)
+			}
+		}()
+	}
+	m.applyRetention(now)
+	return nil
+}
+
+// compressSegment gzip the rotated segment, and replaces the uncompressed one with it.
+// It's called without the lock, which is only taken to replace the segment.
+func (m *messageIO) compressSegment(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := name + gzipExt + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// the segment may have been removed by the retention in the meantime.
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return os.Remove(tmp)
+	}
+	err = os.Rename(tmp, name+gzipExt)
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// applyRetention removes the rotated segments beyond the retention policy.
+// It must be called with the lock held.
+func (m *messageIO) applyRetention(now time.Time) {
+	if m.policy.maxSegments <= 0 && m.policy.maxDays <= 0 {
+		return
+	}
+	segments, err := m.rotatedSegments()
+	if err != nil {
+		m.errHandler(err)
+		return
+	}
+	cutoff := now.Add(-time.Duration(m.policy.maxDays) * 24 * time.Hour)
+	for i, name := range segments {
+		expired := m.policy.maxSegments > 0 && len(segments)-i > m.policy.maxSegments
+		if t, ok := segmentTime(m.path, name); ok && m.policy.maxDays > 0 && t.Before(cutoff) {
+			expired = true
+		}
+		if !expired {
+			continue
+		}
+		err := os.Remove(name)
+		if err != nil {
+			m.errHandler(err)
+		}
+	}
+}
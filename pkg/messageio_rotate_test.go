@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRotatingMessageIO(t *testing.T, policy rotationPolicy) (*messageIO, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	path := filepath.Join(dir, "telchat.log")
+	mio, err := openMessageIO(path, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mio, path
+}
+
+func TestMessageIORotateBySize(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestRotatingMessageIO(t, rotationPolicy{maxSize: 512})
+	defer mio.Close()
+	for i := 0; i < 20; i++ {
+		must(t, mio.writeMessage(newChatMessage("ankur", "default", fmt.Sprint(i), originTelnet)))
+		must(t, mio.Sync())
+	}
+	segments, err := mio.rotatedSegments()
+	must(t, err)
+	if len(segments) < 2 {
+		t.Errorf("expected log file to be rotated got %d segments", len(segments))
+	}
+	// history reads span all the segments in order.
+	got, err := mio.readMessages()
+	must(t, err)
+	if len(got) != 20 {
+		t.Fatalf("expected 20 messages got %d", len(got))
+	}
+	for i, m := range got {
+		if m.Body != fmt.Sprint(i) {
+			t.Errorf("expected message %d got %s", i, m.Body)
+		}
+	}
+}
+
+func TestMessageIORotateByAge(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestRotatingMessageIO(t, rotationPolicy{maxAge: time.Millisecond})
+	defer mio.Close()
+	must(t, mio.writeMessage(newChatMessage("ankur", "default", "old", originTelnet)))
+	time.Sleep(time.Millisecond * 5)
+	must(t, mio.Sync())
+	segments, err := mio.rotatedSegments()
+	must(t, err)
+	if len(segments) != 1 {
+		t.Errorf("expected a single rotated segment got %d", len(segments))
+	}
+}
+
+func TestMessageIORotateByAgeAfterRestart(t *testing.T) {
+	t.Parallel()
+	mio, path := newTestRotatingMessageIO(t, rotationPolicy{})
+	old := newChatMessage("ankur", "default", "old", originTelnet)
+	old.Timestamp = time.Now().Add(-time.Hour * 2).UTC()
+	must(t, mio.writeMessage(old))
+	must(t, mio.Close())
+
+	// the segment appended to after the restart is as old as its first record.
+	mio, err := openMessageIO(path, rotationPolicy{maxAge: time.Hour})
+	must(t, err)
+	defer mio.Close()
+	must(t, mio.writeMessage(newChatMessage("ankur", "default", "new", originTelnet)))
+	must(t, mio.Sync())
+	segments, err := mio.rotatedSegments()
+	must(t, err)
+	if len(segments) != 1 {
+		t.Errorf("expected a single rotated segment got %d", len(segments))
+	}
+}
+
+func TestMessageIORetentionAndCompress(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestRotatingMessageIO(t, rotationPolicy{maxSize: 256, maxSegments: 2, compress: true})
+	defer mio.Close()
+	for i := 0; i < 20; i++ {
+		must(t, mio.writeMessage(newChatMessage("ankur", "default", fmt.Sprint(i), originTelnet)))
+		must(t, mio.Sync())
+	}
+	// the rotated segments are compressed in the background.
+	mio.compressing.Wait()
+	segments, err := mio.rotatedSegments()
+	must(t, err)
+	if len(segments) != 2 {
+		t.Errorf("expected 2 retained segments got %d", len(segments))
+	}
+	for _, name := range segments {
+		if !strings.HasSuffix(name, gzipExt) {
+			t.Errorf("expected segment %s to be compressed", name)
+		}
+	}
+	// the retained messages are still the latest in order.
+	got, err := mio.readMessages()
+	must(t, err)
+	if len(got) == 0 || len(got) == 20 || got[len(got)-1].Body != "19" {
+		t.Fatalf("expected latest messages to be retained got %d", len(got))
+	}
+	for i, m := range got {
+		if m.Body != fmt.Sprint(20-len(got)+i) {
+			t.Errorf("expected message %d got %s", 20-len(got)+i, m.Body)
+		}
+	}
+}
+
+func TestMessageIOHistoryNewestFirst(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestRotatingMessageIO(t, rotationPolicy{maxSize: 256, compress: true})
+	defer mio.Close()
+	for i := 0; i < 20; i++ {
+		must(t, mio.writeMessage(newChatMessage("ankur", "default", fmt.Sprint(i), originTelnet)))
+		must(t, mio.Sync())
+	}
+	mio.compressing.Wait()
+	page, next, err := mio.queryMessages(messageQuery{limit: 5})
+	must(t, err)
+	if len(page) != 5 || next == "" {
+		t.Fatalf("expected a page of 5 messages and a cursor got %d %q", len(page), next)
+	}
+	// break the oldest segment, the reads of the latest messages never reach it.
+	segments, err := mio.rotatedSegments()
+	must(t, err)
+	if len(segments) < 3 {
+		t.Fatalf("expected log file to be rotated got %d segments", len(segments))
+	}
+	must(t, ioutil.WriteFile(segments[0], []byte("broken"), 0644))
+	got, err := mio.lastMessages("default", 3)
+	must(t, err)
+	expected := []string{"17", "18", "19"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d messages got %d", len(expected), len(got))
+	}
+	for i, body := range expected {
+		if got[i].Body != body {
+			t.Errorf("expected message %s got %s", body, got[i].Body)
+		}
+	}
+	// the next page skips the segments rotated before its cursor.
+	page, _, err = mio.queryMessages(messageQuery{limit: 5, cursor: next})
+	must(t, err)
+	if len(page) != 5 || page[0].Body != "5" {
+		t.Fatalf("expected the page to start at message 5 got %v", page)
+	}
+	if _, _, err := mio.queryMessages(messageQuery{limit: 5}); err == nil {
+		t.Errorf("expected reading the broken segment to fail")
+	}
+}
+
+func TestMessageIORetentionByDays(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "telchat.log")
+	old := path + "." + time.Now().Add(-72*time.Hour).UTC().Format(segmentTimeFormat)
+	recent := path + "." + time.Now().Add(-time.Hour).UTC().Format(segmentTimeFormat)
+	for _, name := range []string{old, recent} {
+		must(t, ioutil.WriteFile(name, nil, 0644))
+	}
+	mio, err := openMessageIO(path, rotationPolicy{maxDays: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mio.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expected segment older than max days to be removed got %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("expected recent segment to be retained got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -69,3 +70,181 @@ func TestMessageIO(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageIORecords(t *testing.T) {
+	file, err := ioutil.TempFile("", "telchat.*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	readfile, err := os.OpenFile(file.Name(), os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mio := newMessageIO(file, readfile)
+	defer mio.Close()
+	msgs := []chatMessage{
+		newChatMessage("ankur", "default", "hi message 1", originTelnet),
+		newChatMessage("anand", "new", "hi message\n2", originREST),
+	}
+	for _, m := range msgs {
+		err = mio.writeMessage(m)
+		if err != nil {
+			t.Errorf("err writing to mio failed %v", err)
+		}
+	}
+	err = mio.Sync()
+	if err != nil {
+		t.Errorf("err sync call, err: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond) // some io breather
+
+	got, err := mio.readMessages()
+	if err != nil {
+		t.Fatalf("err reading messages, err: %v", err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("expected %d messages got %d", len(msgs), len(got))
+	}
+	for i, m := range msgs {
+		if got[i].ID != m.ID || got[i].Sender != m.Sender || got[i].Room != m.Room ||
+			got[i].Body != m.Body || got[i].Origin != m.Origin || !got[i].Timestamp.Equal(m.Timestamp) {
+			t.Errorf("expected message %+v got %+v", m, got[i])
+		}
+	}
+}
+
+func TestDecodeMessagesSkipInvalid(t *testing.T) {
+	t.Parallel()
+	buf := new(bytes.Buffer)
+	buf.WriteString("legacy raw message\n\r")
+	err := writeMessage(buf, newChatMessage("ankur", "default", "hi there", originTelnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []chatMessage
+	err = decodeMessages(buf, func(m chatMessage) bool {
+		got = append(got, m)
+		return true
+	})
+	if err != nil {
+		t.Errorf("expected nil err got %v", err)
+	}
+	if len(got) != 1 || got[0].Body != "hi there" {
+		t.Errorf("expected single decoded message got %+v", got)
+	}
+}
+
+func TestMessageIOLastMessages(t *testing.T) {
+	file, err := ioutil.TempFile("", "telchat.*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	readfile, err := os.OpenFile(file.Name(), os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mio := newMessageIO(file, readfile)
+	defer mio.Close()
+	for i := 0; i < 5; i++ {
+		for _, room := range []string{"default", "new"} {
+			err = mio.writeMessage(newChatMessage("ankur", room, fmt.Sprintf("%s %d", room, i), originTelnet))
+			if err != nil {
+				t.Errorf("err writing to mio failed %v", err)
+			}
+		}
+	}
+	err = mio.Sync()
+	if err != nil {
+		t.Errorf("err sync call, err: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond) // some io breather
+
+	got, err := mio.lastMessages("new", 3)
+	if err != nil {
+		t.Fatalf("err reading messages, err: %v", err)
+	}
+	expected := []string{"new 2", "new 3", "new 4"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d messages got %d", len(expected), len(got))
+	}
+	for i, body := range expected {
+		if got[i].Body != body {
+			t.Errorf("expected message %s got %s", body, got[i].Body)
+		}
+	}
+}
+
+func newTestMessageIO(t *testing.T) (*messageIO, string) {
+	t.Helper()
+	file, err := ioutil.TempFile("", "telchat.*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Remove(file.Name())
+	})
+	readfile, err := os.OpenFile(file.Name(), os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMessageIO(file, readfile), file.Name()
+}
+
+func TestMessageIOSyncBlocksUntilWritten(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	defer mio.Close()
+	for i := 0; i < 10; i++ {
+		must(t, mio.writeMessage(newChatMessage("ankur", "default", fmt.Sprint(i), originTelnet)))
+	}
+	must(t, mio.Sync())
+	// no io breather, sync has returned only once written.
+	got, err := mio.readMessages()
+	must(t, err)
+	if len(got) != 10 {
+		t.Errorf("expected 10 messages after sync got %d", len(got))
+	}
+}
+
+func TestMessageIOClose(t *testing.T) {
+	t.Parallel()
+	mio, name := newTestMessageIO(t)
+	must(t, mio.writeMessage(newChatMessage("ankur", "default", "flushed on close", originTelnet)))
+	must(t, mio.Close())
+	// close is idempotent.
+	must(t, mio.Close())
+	if _, err := mio.Write([]byte("late")); err != errMessageIOClosed {
+		t.Errorf("expected closed err on write got %v", err)
+	}
+	if err := mio.Sync(); err != errMessageIOClosed {
+		t.Errorf("expected closed err on sync got %v", err)
+	}
+	b, err := ioutil.ReadFile(name)
+	must(t, err)
+	if !bytes.Contains(b, []byte("flushed on close")) {
+		t.Errorf("expected buffered message to be flushed on close got %s", b)
+	}
+}
+
+func TestMessageIOWriteErrorSurfaced(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	errs := make(chan error, 10)
+	mio.errHandler = func(err error) {
+		errs <- err
+	}
+	// writes to the closed file fails, rather than panic.
+	must(t, mio.file.Close())
+	must(t, mio.writeMessage(newChatMessage("ankur", "default", "lost", originTelnet)))
+	if err := mio.Sync(); err == nil {
+		t.Error("expected sync to return the write err got nil")
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for the err handler")
+	}
+	_ = mio.Close()
+}
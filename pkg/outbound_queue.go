@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overflowPolicy decides what happens when a client's outbound queue is full.
+type overflowPolicy string
+
+const (
+	// dropOldest drops the oldest queued message to make room for the new one.
+	dropOldest overflowPolicy = "drop_oldest"
+	// dropNewest drops the new message.
+	dropNewest overflowPolicy = "drop_newest"
+	// disconnectSlow disconnects the slow consumer.
+	disconnectSlow overflowPolicy = "disconnect"
+
+	defaultQueueSize = 64
+	// flushPollInterval is the interval at which flush checks the queue for being drained.
+	flushPollInterval = 5 * time.Millisecond
+)
+
+// parseOverflowPolicy returns the overflow policy by name, empty name is dropOldest.
+func parseOverflowPolicy(name string) (overflowPolicy, error) {
+	switch p := overflowPolicy(name); p {
+	case "":
+		return dropOldest, nil
+	case dropOldest, dropNewest, disconnectSlow:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// queueConfig configures the outbound queue of each client.
+type queueConfig struct {
+	size   int
+	policy overflowPolicy
+}
+
+var defaultQueueConfig = queueConfig{size: defaultQueueSize, policy: dropOldest}
+
+// deliveryMetrics counts the outbound messages lost across all the clients.
+type deliveryMetrics struct {
+	dropped      uint64 // accessed atomically
+	disconnected uint64 // accessed atomically
+}
+
+// queuedSession wraps a session with a bounded outbound queue drained in order
+// by a single writer goroutine, so a slow client never blocks the sender.
+type queuedSession struct {
+	session
+	cfg     queueConfig
+	metrics *deliveryMetrics
+	dropped uint64 // accessed atomically
+
+	lock    sync.Mutex
+	queue   []chatMessage
+	busy    bool // writer is delivering a message
+	stopped bool
+	notify  chan struct{}
+	done    chan struct{}
+}
+
+func newQueuedSession(sess session, cfg queueConfig, metrics *deliveryMetrics) *queuedSession {
+	if cfg.size <= 0 {
+		cfg.size = defaultQueueSize
+	}
+	qs := &queuedSession{
+		session: sess,
+		cfg:     cfg,
+		metrics: metrics,
+		queue:   make([]chatMessage, 0, cfg.size),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go qs.writeLoop()
+	return qs
+}
+
+// deliver enqueues the message without blocking, applying the overflow policy when the queue is full.
+func (qs *queuedSession) deliver(m chatMessage) error {
+	qs.lock.Lock()
+	if qs.stopped {
+		qs.lock.Unlock()
+		return errSessionClosed
+	}
+	if len(qs.queue) >= qs.cfg.size {
+		qs.countDrop()
+		switch qs.cfg.policy {
+		case dropNewest:
+			qs.lock.Unlock()
+			return nil
+		case disconnectSlow:
+			qs.lock.Unlock()
+			atomic.AddUint64(&qs.metrics.disconnected, 1)
+			log.Printf("disconnecting slow consumer %s\n", qs.remoteIdentity())
+			return qs.close()
+		default:
+			qs.queue = qs.queue[1:]
+		}
+	}
+	qs.queue = append(qs.queue, m)
+	qs.lock.Unlock()
+	select {
+	case qs.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (qs *queuedSession) countDrop() {
+	atomic.AddUint64(&qs.dropped, 1)
+	atomic.AddUint64(&qs.metrics.dropped, 1)
+}
+
+// writeLoop delivers the queued messages in order to the underlying session.
+func (qs *queuedSession) writeLoop() {
+	for {
+		select {
+		case <-qs.done:
+			return
+		case <-qs.notify:
+		}
+		for {
+			qs.lock.Lock()
+			if len(qs.queue) == 0 || qs.stopped {
+				qs.lock.Unlock()
+				break
+			}
+			m := qs.queue[0]
+			qs.queue = qs.queue[1:]
+			qs.busy = true
+			qs.lock.Unlock()
+			err := qs.session.deliver(m)
+			if err != nil {
+				qs.countDrop()
+				log.Printf("failed delivering a message to %s: %v\n", qs.remoteIdentity(), err)
+			}
+			qs.lock.Lock()
+			qs.busy = false
+			qs.lock.Unlock()
+		}
+	}
+}
+
+// pending returns the number of messages waiting in the queue.
+func (qs *queuedSession) pending() int {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	return len(qs.queue)
+}
+
+// flush waits for every queued message to be delivered, or the ctx to be done.
+func (qs *queuedSession) flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		qs.lock.Lock()
+		idle := qs.stopped || (len(qs.queue) == 0 && !qs.busy)
+		qs.lock.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop stops the writer goroutine and discards the queued messages,
+// the underlying session is left open.
+func (qs *queuedSession) stop() {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	if qs.stopped {
+		return
+	}
+	qs.stopped = true
+	qs.queue = nil
+	close(qs.done)
+}
+
+// close stops the queue and closes the underlying session.
+func (qs *queuedSession) close() error {
+	qs.stop()
+	return qs.session.close()
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedSession is a memSession whose deliveries block until the gate is opened.
+type gatedSession struct {
+	memSession
+	gate chan struct{}
+}
+
+func newGatedSession(name string) *gatedSession {
+	return &gatedSession{memSession: memSession{name: name}, gate: make(chan struct{})}
+}
+
+func (gs *gatedSession) deliver(m chatMessage) error {
+	<-gs.gate
+	return gs.memSession.deliver(m)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name   string
+		exp    overflowPolicy
+		expErr bool
+	}{
+		{name: "", exp: dropOldest},
+		{name: "drop_oldest", exp: dropOldest},
+		{name: "drop_newest", exp: dropNewest},
+		{name: "disconnect", exp: disconnectSlow},
+		{name: "block", expErr: true},
+	}
+	for _, tc := range tcs {
+		p, err := parseOverflowPolicy(tc.name)
+		if (err != nil) != tc.expErr || p != tc.exp {
+			t.Errorf("parseOverflowPolicy(%q) expected %q, err %v got %q, %v", tc.name, tc.exp, tc.expErr, p, err)
+		}
+	}
+}
+
+func TestQueuedSessionOrdered(t *testing.T) {
+	t.Parallel()
+	ms := &memSession{name: "ankur"}
+	qs := newQueuedSession(ms, queueConfig{size: 100, policy: dropOldest}, &deliveryMetrics{})
+	defer qs.stop()
+	for i := 0; i < 100; i++ {
+		must(t, qs.deliver(chatMessage{Body: fmt.Sprint(i)}))
+	}
+	msgs := ms.waitMessages(t, 100)
+	for i, m := range msgs {
+		if m.Body != fmt.Sprint(i) {
+			t.Fatalf("expected message %d got %s", i, m.Body)
+		}
+	}
+}
+
+func TestQueuedSessionOverflow(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		policy      overflowPolicy
+		expBodies   []string
+		expDisconn  uint64
+		expDelivErr bool
+	}{
+		{policy: dropOldest, expBodies: []string{"0", "3", "4"}},
+		{policy: dropNewest, expBodies: []string{"0", "1", "2"}},
+		{policy: disconnectSlow, expDisconn: 1, expDelivErr: true},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(string(tc.policy), func(t *testing.T) {
+			t.Parallel()
+			gs := newGatedSession("ankur")
+			metrics := &deliveryMetrics{}
+			qs := newQueuedSession(gs, queueConfig{size: 2, policy: tc.policy}, metrics)
+			defer qs.stop()
+			must(t, qs.deliver(chatMessage{Body: "0"}))
+			// wait for the writer to pick the first message and block on it.
+			for qs.pending() != 0 {
+				time.Sleep(time.Millisecond)
+			}
+			for i := 1; i < 5; i++ {
+				_ = qs.deliver(chatMessage{Body: fmt.Sprint(i)})
+			}
+			close(gs.gate)
+			if tc.expDelivErr {
+				if err := qs.deliver(chatMessage{}); err != errSessionClosed {
+					t.Errorf("expected slow consumer to be disconnected got %v", err)
+				}
+				gs.lock.Lock()
+				closed := gs.closed
+				gs.lock.Unlock()
+				if !closed {
+					t.Errorf("expected underlying session to be closed")
+				}
+			} else {
+				msgs := gs.waitMessages(t, len(tc.expBodies))
+				var bodies []string
+				for _, m := range msgs {
+					bodies = append(bodies, m.Body)
+				}
+				if fmt.Sprint(bodies) != fmt.Sprint(tc.expBodies) {
+					t.Errorf("expected delivered messages %v got %v", tc.expBodies, bodies)
+				}
+				if dropped := atomic.LoadUint64(&qs.dropped); dropped != 2 {
+					t.Errorf("expected 2 dropped messages got %d", dropped)
+				}
+			}
+			if d := atomic.LoadUint64(&metrics.disconnected); d != tc.expDisconn {
+				t.Errorf("expected %d disconnects got %d", tc.expDisconn, d)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// renderer formats the chat output written to a client terminal.
+type renderer interface {
+	// message formats the message of the client to the room.
+	message(ts time.Time, name, room, msg string) string
+	// system formats the chat server notice to the room.
+	system(room roomID, msg string) string
+	// private formats the private message from the client.
+	private(ts time.Time, name, msg string) string
+	// errMsg formats the reason the cmd failed.
+	errMsg(reason, cmd string) string
+	// roomList formats the rooms with their member count.
+	roomList(rooms []roomInfo) string
+	// roomMembers formats the members of the room.
+	roomMembers(room string, members []clientID) string
+	// info formats the name and room information.
+	info(name, room string) string
+	// eraseLine erases the line of n runes typed by the client, and moves back to its start.
+	// The line wraps over the rows of the client window cols wide, zero if unknown.
+	eraseLine(n, cols int) string
+}
+
+// ansiRenderer renders the output with the VT-100 colours and line clearing escape sequences.
+type ansiRenderer struct{}
+
+func (ansiRenderer) message(ts time.Time, name, room, msg string) string {
+	return formatDMAt(ts, name, room, msg)
+}
+
+func (ansiRenderer) system(room roomID, msg string) string {
+	return formatSystemMsg(room, msg)
+}
+
+func (ansiRenderer) private(ts time.Time, name, msg string) string {
+	return formatPM(ts, name, msg)
+}
+
+func (ansiRenderer) errMsg(reason, cmd string) string {
+	return formatErrMsg(reason, cmd)
+}
+
+func (ansiRenderer) roomList(rooms []roomInfo) string {
+	return formatRoomList(rooms)
+}
+
+func (ansiRenderer) roomMembers(room string, members []clientID) string {
+	return formatRoomMembers(room, members)
+}
+
+func (ansiRenderer) info(name, room string) string {
+	return infoDisplay(name, room)
+}
+
+func (ansiRenderer) eraseLine(n, cols int) string {
+	if rows := wrappedRows(n, cols); rows > 0 {
+		// up to the first row of the line, and clear it to the end of the screen.
+		return fmt.Sprintf("\033[%dA\r\033[J", rows)
+	}
+	return "\r\033[K"
+}
+
+// plainRenderer renders the output as plain text, for the dumb terminals, scripts and netcat users.
+type plainRenderer struct{}
+
+func (plainRenderer) message(ts time.Time, name, room, msg string) string {
+	return fmt.Sprintf("%s %s@%s : %s\n\r", ts.Format(time.Stamp), name, room, msg)
+}
+
+func (plainRenderer) system(room roomID, msg string) string {
+	return fmt.Sprintf("*** %s %s\n\r", room, msg)
+}
+
+func (plainRenderer) private(ts time.Time, name, msg string) string {
+	return fmt.Sprintf("%s %s (private) : %s\n\r", ts.Format(time.Stamp), name, msg)
+}
+
+func (plainRenderer) errMsg(reason, cmd string) string {
+	return fmt.Sprintf("[Error]: %s `%s`\n\r", reason, cmd)
+}
+
+func (plainRenderer) roomList(rooms []roomInfo) string {
+	wr := new(bytes.Buffer)
+	w := tabwriter.NewWriter(wr, 0, 8, 4, ' ', 0)
+	fmt.Fprintf(w, " ROOM\tMEMBERS\n")
+	for _, r := range rooms {
+		fmt.Fprintf(w, " %s\t%d\n", r.Name, r.Members)
+	}
+	_ = w.Flush()
+	// the carriage returns are added once aligned, as the tabwriter counts them in the cells.
+	return strings.ReplaceAll(wr.String(), "\n", "\n\r")
+}
+
+func (plainRenderer) roomMembers(room string, members []clientID) string {
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		names = append(names, string(m))
+	}
+	return fmt.Sprintf("[%s] %d members: %s\n\r", room, len(members), strings.Join(names, ", "))
+}
+
+func (plainRenderer) info(name, room string) string {
+	return fmt.Sprintf("%s: [%s] \n\r", name, room)
+}
+
+func (plainRenderer) eraseLine(n, cols int) string {
+	// the cursor can't move up, only the last row of the line is erased.
+	n -= wrappedRows(n, cols) * cols
+	return "\r" + strings.Repeat(" ", n) + "\r"
+}
+
+// wrappedRows returns the number of rows above the cursor taken by the line of n runes,
+// wrapped in the window cols wide. The terminals keep the cursor on the last column
+// of a full row, until the next rune is written.
+func wrappedRows(n, cols int) int {
+	if n == 0 || cols <= 0 {
+		return 0
+	}
+	return (n - 1) / cols
+}
+
+// dumbTerms are the terminal types, told by TTYPE, that don't support the escape sequences.
+var dumbTerms = map[string]bool{"DUMB": true, "UNKNOWN": true, "NETWORK": true}
+
+// rendererForTerm returns the renderer of the terminal type, the unknown
+// terminals are expected to be VT-100 compatible. The clients that don't tell
+// their terminal type, like netcat or the scripts, get the plain text.
+func rendererForTerm(termType string) renderer {
+	if termType == "" || dumbTerms[strings.ToUpper(termType)] {
+		return plainRenderer{}
+	}
+	return ansiRenderer{}
+}
+
+// renderSetting holds the renderer of a conn, that the client can change anytime.
+// The zero value renders with the ANSI renderer.
+type renderSetting struct {
+	v atomic.Value // of rendererBox, as the atomic values must be of the same type.
+}
+
+type rendererBox struct {
+	r renderer
+}
+
+func (rs *renderSetting) renderer() renderer {
+	if b, ok := rs.v.Load().(rendererBox); ok {
+		return b.r
+	}
+	return ansiRenderer{}
+}
+
+func (rs *renderSetting) setRenderer(r renderer) {
+	rs.v.Store(rendererBox{r: r})
+}
+
+// rendererHolder is implemented by the conns that hold the renderer of their client.
+type rendererHolder interface {
+	renderer() renderer
+	setRenderer(r renderer)
+}
+
+// render returns the renderer of the conn, the conns without one render with ANSI.
+func render(conn net.Conn) renderer {
+	if rh, ok := conn.(rendererHolder); ok {
+		return rh.renderer()
+	}
+	return ansiRenderer{}
+}
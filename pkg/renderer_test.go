@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// renderAll renders every kind of output with the renderer.
+func renderAll(r renderer) string {
+	ts := time.Date(2020, 6, 28, 10, 21, 12, 0, time.UTC)
+	var b strings.Builder
+	b.WriteString(r.message(ts, "Ankur", "default", "hi there"))
+	b.WriteString(r.system("default", "anand joined #default"))
+	b.WriteString(r.private(ts, "anand", "hi privately"))
+	b.WriteString(r.errMsg("invalid command", "/room unknown"))
+	b.WriteString(r.roomList([]roomInfo{{Name: "default", Members: 2}, {Name: "myroom3", Members: 1}}))
+	b.WriteString(r.roomMembers("default", []clientID{"Ankur", "anand"}))
+	b.WriteString(r.info("Ankur", "default"))
+	b.WriteString(r.eraseLine(8, 0))
+	b.WriteString(r.eraseLine(20, 8))
+	return b.String()
+}
+
+func TestRenderers(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name string
+		r    renderer
+	}{
+		{name: "ansi", r: ansiRenderer{}},
+		{name: "plain", r: plainRenderer{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			out := renderAll(tc.r)
+			gp := filepath.Join("testdata", t.Name()+".golden")
+			if *update {
+				t.Log("update golden file")
+				if err := os.MkdirAll(filepath.Dir(gp), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(gp, []byte(out), 0644); err != nil {
+					t.Fatalf("failed to update golden file: %s", err)
+				}
+			}
+			g, err := ioutil.ReadFile(gp)
+			if err != nil {
+				t.Fatalf("failed reading .golden: %s", err)
+			}
+			t.Log(out)
+			if !bytes.Equal([]byte(out), g) {
+				t.Errorf("written by the %s renderer does not match .golden file", tc.name)
+			}
+		})
+	}
+	// the plain text never holds an escape sequence.
+	if strings.Contains(renderAll(plainRenderer{}), "\033") {
+		t.Error("expected no escape sequence in plain text")
+	}
+}
+
+func TestRendererForTerm(t *testing.T) {
+	t.Parallel()
+	for term, exp := range map[string]renderer{
+		"XTERM-256COLOR": ansiRenderer{},
+		"VT100":          ansiRenderer{},
+		"dumb":           plainRenderer{},
+		"UNKNOWN":        plainRenderer{},
+		"":               plainRenderer{},
+	} {
+		if r := rendererForTerm(term); r != exp {
+			t.Errorf("%s: expected %T got %T", term, exp, r)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// bearerToken returns the bearer token of the request Authorization header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// identify returns the name the request bearer token was issued to.
+func (rh *restAPIHandler) identify(r *http.Request) (string, bool) {
+	cid, ok := rh.tokens.identify(bearerToken(r))
+	return string(cid), ok
+}
+
+// requireIdentity returns the name of the request bearer token,
+// the request is answered with 401 if the token is missing or unknown.
+func (rh *restAPIHandler) requireIdentity(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name, ok := rh.identify(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="telchat"`)
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+	}
+	return name, ok
+}
+
+// requireAdmin returns true if the request bearer token is the admin token,
+// the request is answered with 401 otherwise.
+func (rh *restAPIHandler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := bearerToken(r)
+	if rh.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(rh.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="telchat admin"`)
+		http.Error(w, "invalid or missing admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// tokenRequest is the POST /admin/tokens request body.
+type tokenRequest struct {
+	Name string `json:"name"`
+}
+
+// issuedToken is the POST /admin/tokens response, the only time the token is shown.
+type issuedToken struct {
+	apiToken
+	Token string `json:"token"`
+}
+
+// adminTokensHandler lists the issued tokens on GET and issues a new one on POST.
+func (rh *restAPIHandler) adminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !rh.requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := rh.tokens.list()
+		if err != nil {
+			log.Printf("unable to load the tokens, err: %v\n", err)
+			http.Error(w, "unable to load the tokens", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, 200, tokens)
+	case http.MethodPost:
+		var tr tokenRequest
+		err := json.NewDecoder(r.Body).Decode(&tr)
+		defer r.Body.Close()
+		if err != nil || len(tr.Name) == 0 {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		t, token, err := rh.tokens.issue(tr.Name)
+		if err != nil {
+			log.Printf("unable to issue the token, err: %v\n", err)
+			http.Error(w, "unable to issue the token", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, 201, issuedToken{apiToken: t, Token: token})
+	default:
+		http.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminTokenHandler revokes the token /admin/tokens/{id} on DELETE.
+func (rh *restAPIHandler) adminTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !rh.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tokens/"), "/")
+	err := rh.tokens.revoke(id)
+	if errors.Is(err, errUnknownToken) {
+		http.Error(w, "unknown token", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("unable to revoke the token, err: %v\n", err)
+		http.Error(w, "unable to revoke the token", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
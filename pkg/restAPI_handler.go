@@ -3,14 +3,23 @@ package pkg
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type restAPIHandler struct {
 	mio           *messageIO
 	mux           *http.ServeMux
 	chatDataStore *chatDataStore
+	tokens        *tokenStore
+	// adminToken is the bearer token of the admin endpoints, empty disables them.
+	adminToken string
 }
 
 func (rh *restAPIHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -18,13 +27,66 @@ func (rh *restAPIHandler) ServeHTTP(writer http.ResponseWriter, request *http.Re
 }
 
 func newRestAPIHandler(io *messageIO, store *chatDataStore) *restAPIHandler {
+	return newRestAPIHandlerWithTokens(io, store, newTokenStore(), "")
+}
+
+// newRestAPIHandlerWithTokens returns the rest api handler authenticating the clients with the tokens.
+func newRestAPIHandlerWithTokens(io *messageIO, store *chatDataStore, tokens *tokenStore, adminToken string) *restAPIHandler {
 	mux := http.NewServeMux()
-	rh := &restAPIHandler{mio: io, mux: mux, chatDataStore: store}
+	rh := &restAPIHandler{mio: io, mux: mux, chatDataStore: store, tokens: tokens, adminToken: adminToken}
 	mux.Handle("/messages", http.HandlerFunc(rh.messageHandler))
 	mux.Handle("/post", http.HandlerFunc(rh.postMessageHandler))
+	mux.Handle("/msg", http.HandlerFunc(rh.directMessageHandler))
+	mux.Handle("/rooms", http.HandlerFunc(rh.roomListHandler))
+	mux.Handle("/rooms/", http.HandlerFunc(rh.roomsHandler))
+	mux.Handle("/metrics", http.HandlerFunc(rh.metricsHandler))
+	mux.Handle("/admin/tokens", http.HandlerFunc(rh.adminTokensHandler))
+	mux.Handle("/admin/tokens/", http.HandlerFunc(rh.adminTokenHandler))
 	return rh
 }
 
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// messagePage is a single page of the GET /messages response.
+type messagePage struct {
+	Messages   []chatMessage `json:"messages"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// parseMessageQuery parses the GET /messages query parameters.
+func parseMessageQuery(r *http.Request) (messageQuery, error) {
+	v := r.URL.Query()
+	q := messageQuery{
+		room:   roomID(v.Get("room")),
+		sender: clientID(v.Get("sender")),
+		cursor: v.Get("cursor"),
+		limit:  defaultPageLimit,
+	}
+	var err error
+	if since := v.Get("since"); since != "" {
+		q.since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return q, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if until := v.Get("until"); until != "" {
+		q.until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return q, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if limit := v.Get("limit"); limit != "" {
+		q.limit, err = strconv.Atoi(limit)
+		if err != nil || q.limit <= 0 || q.limit > maxPageLimit {
+			return q, fmt.Errorf("invalid limit: must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return q, nil
+}
+
 // all the message handler.
 func (rh *restAPIHandler) messageHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -32,21 +94,50 @@ func (rh *restAPIHandler) messageHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	msg, err := rh.mio.ReadAll()
+	q, err := parseMessageQuery(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the token is optional, the anonymous clients can read only the public rooms.
+	name, _ := rh.identify(r)
+	if q.room != "" {
+		err = rh.chatDataStore.checkRoomAccess(name, string(q.room))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else {
+		q.readable = rh.readableRooms(name)
+	}
+	msgs, next, err := rh.mio.queryMessages(q)
+	if errors.Is(err, errInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(200)
-	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-	_, err = w.Write(msg)
 	if err != nil {
-		log.Printf("ResponseWriter error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, 200, messagePage{Messages: msgs, NextCursor: next})
+}
+
+// readableRooms returns the filter of the rooms the client can read, the access
+// of each room is checked once.
+func (rh *restAPIHandler) readableRooms(name string) func(roomID) bool {
+	readable := make(map[roomID]bool)
+	return func(room roomID) bool {
+		ok, checked := readable[room]
+		if !checked {
+			ok = rh.chatDataStore.checkRoomAccess(name, string(room)) == nil
+			readable[room] = ok
+		}
+		return ok
 	}
 }
 
+// message is the POST /post request body, the sender is the name of the token.
 type message struct {
-	Name string `json:"name"`
 	Room string `json:"room"`
 	Msg  string `json:"msg"`
 }
@@ -57,6 +148,10 @@ func (rh *restAPIHandler) postMessageHandler(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	name, ok := rh.requireIdentity(w, r)
+	if !ok {
+		return
+	}
 	var m message
 	err := json.NewDecoder(r.Body).Decode(&m)
 	defer r.Body.Close()
@@ -64,18 +159,271 @@ func (rh *restAPIHandler) postMessageHandler(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "bad request body", http.StatusBadRequest)
 		return
 	}
-	if len(m.Name) == 0 || len(m.Msg) == 0 || len(m.Room) == 0 {
+	if len(m.Msg) == 0 || len(m.Room) == 0 {
 		http.Error(w, "bad request body", http.StatusBadRequest)
 		return
 	}
+	err = rh.chatDataStore.checkRoomAccess(name, m.Room)
+	if err == nil {
+		err = rh.chatDataStore.checkSend(name, m.Room)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	// req context can get closed anytime so don;t use request context.
-	rh.chatDataStore.broadcastMsg(context.TODO(), m.Name, m.Room, []byte(formatDM(m.Name, m.Room, m.Msg)))
-	rh.logWriter(m.Msg)
+	cm := newChatMessage(name, m.Room, m.Msg, originREST)
+	rh.chatDataStore.broadcastMsg(context.TODO(), cm)
+	rh.logWriter(cm)
 	w.WriteHeader(201)
 }
 
-func (rh *restAPIHandler) logWriter(command string) {
-	_, err := rh.mio.Write([]byte(command + "\n\r")) // write message to the log file
+// directMessage is the POST /msg request body, the sender is the name of the token.
+type directMessage struct {
+	To  string `json:"to"`
+	Msg string `json:"msg"`
+}
+
+// direct message handler, delivers the message privately to the recipient.
+func (rh *restAPIHandler) directMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := rh.requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	var m directMessage
+	err := json.NewDecoder(r.Body).Decode(&m)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+	if len(m.Msg) == 0 || len(m.To) == 0 {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+	cm := newDirectMessage(name, m.To, m.Msg, originREST)
+	err = rh.chatDataStore.directMsg(context.TODO(), cm)
+	if errors.Is(err, errUnknownClient) {
+		http.Error(w, "unknown client", http.StatusNotFound)
+		return
+	}
+	rh.logWriter(cm)
+	w.WriteHeader(201)
+}
+
+// roomsHandler routes all the /rooms/{room}/... requests.
+func (rh *restAPIHandler) roomsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/"), "/")
+	if len(parts) == 1 && len(parts[0]) != 0 {
+		rh.roomHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && len(parts[0]) != 0 {
+		switch parts[1] {
+		case "stream":
+			rh.roomStreamHandler(w, r, parts[0])
+			return
+		case "members":
+			rh.roomMembersHandler(w, r, parts[0])
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// roomListHandler returns all the rooms with their member count,
+// the private rooms only to the clients allowed in.
+func (rh *restAPIHandler) roomListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, _ := rh.identify(r)
+	readable := rh.readableRooms(name)
+	rooms := make([]roomInfo, 0)
+	for _, info := range rh.chatDataStore.listRooms() {
+		if readable(info.Name) {
+			rooms = append(rooms, info)
+		}
+	}
+	writeJSON(w, 200, rooms)
+}
+
+type roomMembers struct {
+	Room    string     `json:"room"`
+	Members []clientID `json:"members"`
+}
+
+// roomMembersHandler returns the clients that are part of the room.
+func (rh *restAPIHandler) roomMembersHandler(w http.ResponseWriter, r *http.Request, room string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// the token is optional, the anonymous clients can list only the public rooms.
+	name, _ := rh.identify(r)
+	err := rh.chatDataStore.checkRoomAccess(name, room)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	members, ok := rh.chatDataStore.roomMembers(room)
+	if !ok {
+		http.Error(w, "unknown room", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, 200, roomMembers{Room: room, Members: members})
+}
+
+// roomUpdate is the PUT /rooms/{room} request body, absent fields are left unchanged.
+type roomUpdate struct {
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+}
+
+// roomHandler returns the metadata of the room on GET and updates its topic and description on PUT.
+func (rh *restAPIHandler) roomHandler(w http.ResponseWriter, r *http.Request, room string) {
+	switch r.Method {
+	case http.MethodGet:
+		// the token is optional, the anonymous clients can read only the public rooms.
+		name, _ := rh.identify(r)
+		err := rh.chatDataStore.checkRoomAccess(name, room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		meta, ok := rh.chatDataStore.roomMetadata(room)
+		if !ok {
+			http.Error(w, "unknown room", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, 200, meta)
+	case http.MethodPut:
+		name, ok := rh.requireIdentity(w, r)
+		if !ok {
+			return
+		}
+		var u roomUpdate
+		err := json.NewDecoder(r.Body).Decode(&u)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		err = rh.chatDataStore.checkRoomAccess(name, room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		meta, err := rh.chatDataStore.updateRoomMeta(room, name, u.Topic, u.Description)
+		if errors.Is(err, errUnknownRoom) {
+			http.Error(w, "unknown room", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("unable to save the rooms metadata, err: %v\n", err)
+			http.Error(w, "unable to save the room", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, 200, meta)
+	default:
+		http.Error(w, "Only GET and PUT are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON writes v as the JSON response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("ResponseWriter error: %v", err)
+	}
+}
+
+const (
+	// streamKeepAlive is the interval at which a comment is sent on idle room streams.
+	streamKeepAlive = 15 * time.Second
+	// streamBufferSize is the number of message buffered for each room stream
+	// before new messages are dropped for it.
+	streamBufferSize = 16
+)
+
+// roomStreamHandler streams the new messages of the room as Server-Sent Events.
+func (rh *restAPIHandler) roomStreamHandler(w http.ResponseWriter, r *http.Request, room string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// the token is optional, the anonymous clients can follow only the public rooms.
+	name, _ := rh.identify(r)
+	err := rh.chatDataStore.checkRoomAccess(name, room)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ss := newStreamSession(r.RemoteAddr, streamBufferSize)
+	unwatch := rh.chatDataStore.watchRoom(room, ss)
+	defer func() {
+		unwatch()
+		_ = ss.close()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case m, ok := <-ss.msgs:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				log.Printf("unable to marshal stream message, err: %v", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", m.ID, data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// metricsHandler returns the outbound queue metrics of the chat data store.
+func (rh *restAPIHandler) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, 200, rh.chatDataStore.outboundMetrics())
+}
+
+func (rh *restAPIHandler) logWriter(m chatMessage) {
+	err := rh.mio.writeMessage(m) // write message to the log file
 	if err != nil {
 		log.Println("error writing message to the log file")
 	}
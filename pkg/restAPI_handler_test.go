@@ -1,12 +1,19 @@
 package pkg
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRestAPIHandler_ServeHTTP(t *testing.T) {
@@ -21,6 +28,7 @@ func TestRestAPIHandler_ServeHTTP(t *testing.T) {
 		t.Fatal(err)
 	}
 	rh := newRestAPIHandler(newMessageIO(file, readfile), newChatDataStore(ioutil.Discard))
+	token := issueToken(t, rh, "Ankur")
 
 	tcPostM := []struct {
 		name    string
@@ -28,15 +36,27 @@ func TestRestAPIHandler_ServeHTTP(t *testing.T) {
 		expCode int
 	}{
 		{
-			name: "invalid body",
+			name: "missing token",
 			req: httptest.NewRequest(http.MethodPost, "/post",
-				ioutil.NopCloser(bytes.NewBuffer([]byte("")))),
+				ioutil.NopCloser(bytes.NewBuffer(validReq))),
+			expCode: 401,
+		},
+		{
+			name: "invalid token",
+			req: authorize(httptest.NewRequest(http.MethodPost, "/post",
+				ioutil.NopCloser(bytes.NewBuffer(validReq))), "guess"),
+			expCode: 401,
+		},
+		{
+			name: "invalid body",
+			req: authorize(httptest.NewRequest(http.MethodPost, "/post",
+				ioutil.NopCloser(bytes.NewBuffer([]byte("")))), token),
 			expCode: 400,
 		},
 		{
 			name: "valid body",
-			req: httptest.NewRequest(http.MethodPost, "/post",
-				ioutil.NopCloser(bytes.NewBuffer(validReq))),
+			req: authorize(httptest.NewRequest(http.MethodPost, "/post",
+				ioutil.NopCloser(bytes.NewBuffer(validReq))), token),
 			expCode: 201,
 		},
 	}
@@ -58,10 +78,451 @@ func TestRestAPIHandler_ServeHTTP(t *testing.T) {
 	if rsp.Code != 200 {
 		t.Errorf("expected response code %d got %d", 200, rsp.Code)
 	}
+	var page messagePage
+	if err := json.NewDecoder(rsp.Body).Decode(&page); err != nil {
+		t.Errorf("expected json messages response got err %v", err)
+	}
+}
+
+func TestRestAPIHandler_MessagesQuery(t *testing.T) {
+	t.Parallel()
+	file, err := ioutil.TempFile("", "telchat.*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	readfile, err := os.OpenFile(file.Name(), os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mio := newMessageIO(file, readfile)
+	rh := newRestAPIHandler(mio, newChatDataStore(ioutil.Discard))
+	start := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		must(t, mio.writeMessage(newChatMessage("ankur", "default", fmt.Sprintf("ankur %d", i), originTelnet)))
+		must(t, mio.writeMessage(newChatMessage("anand", "new", fmt.Sprintf("anand %d", i), originREST)))
+	}
+	must(t, mio.Sync())
+	time.Sleep(500 * time.Millisecond) // some io breather
+
+	query := func(t *testing.T, params url.Values) (messagePage, int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/messages?"+params.Encode(), nil)
+		rsp := httptest.NewRecorder()
+		rh.ServeHTTP(rsp, req)
+		var page messagePage
+		if rsp.Code == 200 {
+			must(t, json.NewDecoder(rsp.Body).Decode(&page))
+		}
+		return page, rsp.Code
+	}
+
+	// paginate through a filtered room.
+	var bodies []string
+	params := url.Values{"room": {"default"}, "limit": {"2"}}
+	for pages := 0; pages < 5; pages++ {
+		page, code := query(t, params)
+		if code != 200 {
+			t.Fatalf("expected response code %d got %d", 200, code)
+		}
+		for _, m := range page.Messages {
+			bodies = append(bodies, m.Body)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", page.NextCursor)
+	}
+	expected := []string{"ankur 0", "ankur 1", "ankur 2", "ankur 3", "ankur 4"}
+	if fmt.Sprint(bodies) != fmt.Sprint(expected) {
+		t.Errorf("expected paginated messages %v got %v", expected, bodies)
+	}
+
+	page, code := query(t, url.Values{"sender": {"anand"}, "since": {start.Add(-time.Minute).Format(time.RFC3339)}})
+	if code != 200 || len(page.Messages) != 5 || page.NextCursor != "" {
+		t.Errorf("expected 5 messages from sender anand got %d, code %d", len(page.Messages), code)
+	}
+	page, code = query(t, url.Values{"until": {start.Add(-time.Minute).Format(time.RFC3339)}})
+	if code != 200 || len(page.Messages) != 0 {
+		t.Errorf("expected no messages until past time got %d, code %d", len(page.Messages), code)
+	}
+
+	for _, params := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"abc"}},
+		{"since": {"yesterday"}},
+		{"cursor": {"unknown"}},
+	} {
+		if _, code := query(t, params); code != 400 {
+			t.Errorf("expected response code %d for %v got %d", 400, params, code)
+		}
+	}
+}
+
+// issueToken returns a new REST API token of the name.
+func issueToken(t *testing.T, rh *restAPIHandler, name string) string {
+	t.Helper()
+	_, token, err := rh.tokens.issue(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// authorize sets the bearer token of the request.
+func authorize(req *http.Request, token string) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
 }
 
 var validReq = []byte(`{
-    "name": "Ankur",
     "room": "new",
     "msg": "Hi There from browser"
 }`)
+
+func TestRestAPIHandler_RoomStream(t *testing.T) {
+	t.Parallel()
+	file, err := ioutil.TempFile("", "telchat.*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	readfile, err := os.OpenFile(file.Name(), os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newChatDataStore(ioutil.Discard)
+	rh := newRestAPIHandler(newMessageIO(file, readfile), store)
+	srv := httptest.NewServer(rh)
+	defer srv.Close()
+
+	rsp, err := http.Get(srv.URL + "/rooms/new/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if ct := rsp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected content type text/event-stream got %s", ct)
+	}
+
+	// message to another room should not be streamed.
+	store.broadcastMsg(context.Background(), newChatMessage("anand", "default", "not streamed", originTelnet))
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/post", bytes.NewBuffer(validReq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := http.DefaultClient.Do(authorize(req, issueToken(t, rh, "Ankur")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.Body.Close()
+
+	events := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(rsp.Body)
+		for sc.Scan() {
+			if strings.HasPrefix(sc.Text(), "data: ") {
+				events <- strings.TrimPrefix(sc.Text(), "data: ")
+			}
+		}
+		close(events)
+	}()
+	select {
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout waiting for stream event")
+	case data := <-events:
+		var m chatMessage
+		must(t, json.Unmarshal([]byte(data), &m))
+		if m.Sender != "Ankur" || m.Room != "new" || m.Body != "Hi There from browser" || m.Origin != originREST {
+			t.Errorf("unexpected streamed message %+v", m)
+		}
+	}
+
+	// closing all the conn should end the stream.
+	store.closeAllConn()
+	select {
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout waiting for stream close")
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected stream to be closed")
+		}
+	}
+}
+
+func TestRestAPIHandler_DirectMessage(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	defer mio.Close()
+	store := newChatDataStore(ioutil.Discard)
+	anand := &memSession{name: "anand"}
+	must(t, store.registerClient("anand", anand))
+	rh := newRestAPIHandler(mio, store)
+	token := issueToken(t, rh, "Ankur")
+
+	tcs := []struct {
+		name    string
+		body    string
+		token   string
+		expCode int
+	}{
+		{name: "missing token", body: `{"to": "anand", "msg": "hi"}`, expCode: 401},
+		{name: "invalid body", body: `{"to": "anand"}`, token: token, expCode: 400},
+		{name: "unknown client", body: `{"to": "nobody", "msg": "hi"}`, token: token, expCode: 404},
+		{name: "valid body", body: `{"to": "anand", "msg": "hi privately"}`, token: token, expCode: 201},
+	}
+	for _, tc := range tcs {
+		rsp := httptest.NewRecorder()
+		rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/msg", bytes.NewBufferString(tc.body)), tc.token))
+		if rsp.Code != tc.expCode {
+			t.Errorf("%s: expected response code %d got %d", tc.name, tc.expCode, rsp.Code)
+		}
+	}
+	msgs := anand.waitMessages(t, 1)
+	if len(msgs) != 1 || msgs[0].Kind != kindDirect || msgs[0].Body != "hi privately" || msgs[0].Sender != "Ankur" {
+		t.Errorf("expected a single private message got %+v", msgs)
+	}
+
+	// private messages are persisted, but never listed.
+	must(t, mio.Sync())
+	all, err := mio.readMessages()
+	must(t, err)
+	if len(all) != 1 || all[0].Kind != kindDirect || all[0].Recipient != "anand" {
+		t.Errorf("expected persisted private message got %+v", all)
+	}
+	rsp := httptest.NewRecorder()
+	rh.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/messages", nil))
+	var page messagePage
+	must(t, json.NewDecoder(rsp.Body).Decode(&page))
+	if len(page.Messages) != 0 {
+		t.Errorf("expected private messages to not be listed got %d", len(page.Messages))
+	}
+}
+
+func TestRestAPIHandler_Rooms(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	defer mio.Close()
+	store := newChatDataStore(ioutil.Discard)
+	for _, name := range []string{"ankur", "anand", "ankuranand"} {
+		must(t, store.registerClient(name, &memSession{name: name}))
+	}
+	store.removeClientFromRoom("ankuranand", metaRoom)
+	store.addClientToRoom("ankuranand", "new")
+	rh := newRestAPIHandler(mio, store)
+
+	rsp := httptest.NewRecorder()
+	rh.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/rooms", nil))
+	var rooms []roomInfo
+	must(t, json.NewDecoder(rsp.Body).Decode(&rooms))
+	expRooms := []roomInfo{{Name: "default", Members: 2}, {Name: "new", Members: 1}}
+	if fmt.Sprint(rooms) != fmt.Sprint(expRooms) {
+		t.Errorf("expected rooms %v got %v", expRooms, rooms)
+	}
+
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/rooms/default/members", nil))
+	var members roomMembers
+	must(t, json.NewDecoder(rsp.Body).Decode(&members))
+	if members.Room != "default" || fmt.Sprint(members.Members) != "[anand ankur]" {
+		t.Errorf("expected default room members [anand ankur] got %+v", members)
+	}
+
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/rooms/unknown/members", nil))
+	if rsp.Code != 404 {
+		t.Errorf("expected response code %d got %d", 404, rsp.Code)
+	}
+}
+
+func TestRestAPIHandler_RoomMeta(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	defer mio.Close()
+	store := newChatDataStore(ioutil.Discard)
+	ankur := &memSession{name: "ankur"}
+	must(t, store.registerClient("ankur", ankur))
+	rh := newRestAPIHandler(mio, store)
+	token := issueToken(t, rh, "anand")
+
+	tcs := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		expCode int
+	}{
+		{name: "unknown room", method: http.MethodGet, path: "/rooms/unknown", expCode: 404},
+		{name: "missing token", method: http.MethodPut, path: "/rooms/default", body: `{"topic": "hi"}`, expCode: 401},
+		{name: "unknown room update", method: http.MethodPut, path: "/rooms/unknown", body: `{"topic": "hi"}`, expCode: 404},
+		{name: "invalid body", method: http.MethodPut, path: "/rooms/default", body: `{"topic": 1}`, expCode: 400},
+		{name: "invalid method", method: http.MethodPost, path: "/rooms/default", body: `{}`, expCode: 405},
+		{name: "update topic", method: http.MethodPut, path: "/rooms/default", body: `{"topic": "hi there", "description": "general chat"}`, expCode: 200},
+		{name: "update description", method: http.MethodPut, path: "/rooms/default", body: `{"description": "all of us"}`, expCode: 200},
+	}
+	for _, tc := range tcs {
+		rsp := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.name != "missing token" {
+			req = authorize(req, token)
+		}
+		rh.ServeHTTP(rsp, req)
+		if rsp.Code != tc.expCode {
+			t.Errorf("%s: expected response code %d got %d", tc.name, tc.expCode, rsp.Code)
+		}
+	}
+
+	rsp := httptest.NewRecorder()
+	rh.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/rooms/default", nil))
+	var r roomMeta
+	must(t, json.NewDecoder(rsp.Body).Decode(&r))
+	if r.Name != metaRoom || r.Topic != "hi there" || r.Description != "all of us" {
+		t.Errorf("unexpected room metadata %+v", r)
+	}
+	msgs := ankur.waitMessages(t, 1)
+	if len(msgs) == 1 && msgs[0].Body != "anand changed the topic to: hi there" {
+		t.Errorf("expected topic notice got %s", msgs[0].Body)
+	}
+}
+
+func TestRestAPIHandler_PrivateRoom(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	defer mio.Close()
+	store := newChatDataStore(ioutil.Discard)
+	must(t, store.registerClient("ankur", &memSession{name: "ankur"}))
+	store.addClientToRoom("ankur", "secret")
+	must(t, store.setRoomMode("ankur", "secret", modePassword, "s3cret"))
+	rh := newRestAPIHandler(mio, store)
+	anand := issueToken(t, rh, "anand")
+
+	// anonymous and non member clients can't follow or post to the private room.
+	for _, token := range []string{"", anand} {
+		rsp := httptest.NewRecorder()
+		rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, "/rooms/secret/stream", nil), token))
+		if rsp.Code != 403 {
+			t.Errorf("expected response code %d got %d", 403, rsp.Code)
+		}
+	}
+	rsp := httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(`{"room": "secret", "msg": "hi"}`)), anand))
+	if rsp.Code != 403 {
+		t.Errorf("expected response code %d got %d", 403, rsp.Code)
+	}
+	// the members can.
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(`{"room": "secret", "msg": "hi"}`)), issueToken(t, rh, "ankur")))
+	if rsp.Code != 201 {
+		t.Errorf("expected response code %d got %d", 201, rsp.Code)
+	}
+
+	must(t, mio.Sync())
+	// nor read its history, members or metadata, nor see it listed.
+	for _, path := range []string{"/messages?room=secret", "/rooms/secret/members", "/rooms/secret"} {
+		for _, token := range []string{"", anand} {
+			rsp = httptest.NewRecorder()
+			rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, path, nil), token))
+			if rsp.Code != 403 {
+				t.Errorf("%s: expected response code %d got %d", path, 403, rsp.Code)
+			}
+		}
+	}
+	for _, path := range []string{"/messages", "/rooms"} {
+		for _, token := range []string{"", anand} {
+			rsp = httptest.NewRecorder()
+			rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, path, nil), token))
+			if rsp.Code != 200 || strings.Contains(rsp.Body.String(), "secret") {
+				t.Errorf("%s: expected the private room to be left out got %d %s", path, rsp.Code, rsp.Body.String())
+			}
+		}
+	}
+	ankur := issueToken(t, rh, "ankur")
+	for _, path := range []string{"/messages?room=secret", "/messages", "/rooms/secret/members", "/rooms"} {
+		rsp = httptest.NewRecorder()
+		rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, path, nil), ankur))
+		if rsp.Code != 200 || !strings.Contains(rsp.Body.String(), "secret") {
+			t.Errorf("%s: expected the member to read the private room got %d %s", path, rsp.Code, rsp.Body.String())
+		}
+	}
+
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, "/rooms/secret", nil), ankur))
+	if strings.Contains(rsp.Body.String(), "password_hash") || !strings.Contains(rsp.Body.String(), `"mode":"password"`) {
+		t.Errorf("unexpected room metadata %s", rsp.Body.String())
+	}
+}
+
+func TestRestAPIHandler_AdminTokens(t *testing.T) {
+	t.Parallel()
+	mio, _ := newTestMessageIO(t)
+	defer mio.Close()
+	store := newChatDataStore(ioutil.Discard)
+	anand := &memSession{name: "anand"}
+	must(t, store.registerClient("anand", anand))
+
+	// the admin endpoints are disabled without an admin token.
+	rh := newRestAPIHandler(mio, store)
+	rsp := httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, "/admin/tokens", nil), ""))
+	if rsp.Code != 401 {
+		t.Errorf("expected response code %d got %d", 401, rsp.Code)
+	}
+
+	rh = newRestAPIHandlerWithTokens(mio, store, newTokenStore(), "admin-secret")
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(`{"name": "ankur"}`)), "guess"))
+	if rsp.Code != 401 {
+		t.Errorf("expected response code %d got %d", 401, rsp.Code)
+	}
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(`{}`)), "admin-secret"))
+	if rsp.Code != 400 {
+		t.Errorf("expected response code %d got %d", 400, rsp.Code)
+	}
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(`{"name": "ankur"}`)), "admin-secret"))
+	if rsp.Code != 201 {
+		t.Fatalf("expected response code %d got %d", 201, rsp.Code)
+	}
+	var issued issuedToken
+	must(t, json.NewDecoder(rsp.Body).Decode(&issued))
+	if issued.Name != "ankur" || issued.ID == "" || issued.Token == "" || issued.Hash != "" {
+		t.Errorf("unexpected issued token %+v", issued)
+	}
+
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodGet, "/admin/tokens", nil), "admin-secret"))
+	if strings.Contains(rsp.Body.String(), issued.Token) || !strings.Contains(rsp.Body.String(), issued.ID) {
+		t.Errorf("unexpected token list %s", rsp.Body.String())
+	}
+
+	// the sender is the name of the token, not the one of the body.
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/post",
+		strings.NewReader(`{"name": "anand", "room": "default", "msg": "hi"}`)), issued.Token))
+	if rsp.Code != 201 {
+		t.Errorf("expected response code %d got %d", 201, rsp.Code)
+	}
+	msgs := anand.waitMessages(t, 1)
+	if len(msgs) != 1 || msgs[0].Sender != "ankur" {
+		t.Errorf("expected message from ankur got %+v", msgs)
+	}
+
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodDelete, "/admin/tokens/"+issued.ID, nil), "admin-secret"))
+	if rsp.Code != 204 {
+		t.Errorf("expected response code %d got %d", 204, rsp.Code)
+	}
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodDelete, "/admin/tokens/"+issued.ID, nil), "admin-secret"))
+	if rsp.Code != 404 {
+		t.Errorf("expected response code %d got %d", 404, rsp.Code)
+	}
+	// the revoked token is not accepted anymore.
+	rsp = httptest.NewRecorder()
+	rh.ServeHTTP(rsp, authorize(httptest.NewRequest(http.MethodPost, "/post",
+		strings.NewReader(`{"room": "default", "msg": "hi"}`)), issued.Token))
+	if rsp.Code != 401 {
+		t.Errorf("expected response code %d got %d", 401, rsp.Code)
+	}
+}
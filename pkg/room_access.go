@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// roomMode controls who can join a room.
+type roomMode string
+
+const (
+	// modePublic rooms can be joined by anyone, it's the mode of the rooms without one.
+	modePublic roomMode = "public"
+	// modeInvite rooms can be joined only by the clients invited by the room owner.
+	modeInvite roomMode = "invite"
+	// modePassword rooms can be joined only with the room password.
+	modePassword roomMode = "password"
+)
+
+// passwordCost is the bcrypt cost of the hashed passwords.
+var passwordCost = bcrypt.DefaultCost
+
+var (
+	errRoomInviteOnly  = errors.New("room is invite only")
+	errRoomPassword    = errors.New("wrong room password")
+	errNotRoomOwner    = errors.New("not the room owner")
+	errInvalidRoomMode = errors.New("invalid room mode")
+	errNotRoomMember   = errors.New("not a member of room")
+	errPrivateRoom     = errors.New("private room")
+)
+
+// parseRoomMode parses the room mode, empty is public.
+func parseRoomMode(s string) (roomMode, error) {
+	switch roomMode(s) {
+	case "", modePublic:
+		return modePublic, nil
+	case modeInvite, modePassword:
+		return roomMode(s), nil
+	default:
+		return "", errInvalidRoomMode
+	}
+}
+
+// canJoin checks the room access mode for the client, the owner and the
+// current members can always join. verified is the password hash the secret
+// of the client was compared with, the password must not have changed since.
+func (r *roomMeta) canJoin(cid clientID, verified []byte) error {
+	if cid == r.Creator {
+		return nil
+	}
+	switch r.Mode {
+	case modeInvite:
+		if !r.Invited[cid] {
+			return errRoomInviteOnly
+		}
+	case modePassword:
+		if verified == nil || !bytes.Equal(r.PasswordHash, verified) {
+			return errRoomPassword
+		}
+	}
+	return nil
+}
+
+// checkRoomAccess returns the reason the client can't follow or post to the room without joining it, if any.
+// The public rooms are open to everyone, the private ones only to their members, owner and invited clients.
+// An empty name is an anonymous client, the rooms not created yet are public.
+func (cds *chatDataStore) checkRoomAccess(clientName, roomName string) error {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	roomId := roomID(roomName)
+	r, ok := cds.rooms.get(roomId)
+	if !ok {
+		return nil
+	}
+	cid := clientID(clientName)
+	if clientName != "" && r.isBanned(cid, time.Now()) {
+		return errBannedFromRoom
+	}
+	if r.Mode == "" || r.Mode == modePublic {
+		return nil
+	}
+	if clientName == "" {
+		return errPrivateRoom
+	}
+	if _, ok := cds.roomsSubscribers[roomId][cid]; ok {
+		return nil
+	}
+	if cid == r.Creator || (r.Mode == modeInvite && r.Invited[cid]) {
+		return nil
+	}
+	return errPrivateRoom
+}
+
+// joinRoom adds the client to the room if the room access mode allows it.
+// The secret is the password of the password protected rooms.
+func (cds *chatDataStore) joinRoom(clientName, roomName, secret string) error {
+	cid := clientID(clientName)
+	roomId := roomID(roomName)
+	// bcrypt is slow by design, the secret is compared without holding the lock.
+	hash := cds.roomPasswordHash(cid, roomId)
+	if hash != nil && bcrypt.CompareHashAndPassword(hash, []byte(secret)) != nil {
+		return errRoomPassword
+	}
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	if _, ok := cds.roomsSubscribers[roomId][cid]; ok {
+		return nil
+	}
+	if r, ok := cds.rooms.get(roomId); ok {
+		if r.isBanned(cid, time.Now()) {
+			return errBannedFromRoom
+		}
+		err := r.canJoin(cid, hash)
+		if err != nil {
+			return err
+		}
+	}
+	cds.enterRoom(cid, roomId)
+	return nil
+}
+
+// roomPasswordHash returns the password hash the client must know to join the room,
+// nil if the room has none or the client needs no password to join it.
+func (cds *chatDataStore) roomPasswordHash(cid clientID, roomId roomID) []byte {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	if _, ok := cds.roomsSubscribers[roomId][cid]; ok {
+		return nil
+	}
+	r, ok := cds.rooms.get(roomId)
+	if !ok || r.Mode != modePassword || cid == r.Creator {
+		return nil
+	}
+	return r.PasswordHash
+}
+
+// setRoomMode changes the access mode of the room, only the room owner can change it.
+// The secret is the new password of the password protected room.
+func (cds *chatDataStore) setRoomMode(clientName, roomName string, mode roomMode, secret string) error {
+	err := cds.checkRoomOwner(clientName, roomName)
+	if err != nil {
+		return err
+	}
+	var hash []byte
+	if mode == modePassword {
+		if secret == "" {
+			return errRoomPassword
+		}
+		// bcrypt is slow by design, the hash is generated without holding the lock.
+		hash, err = bcrypt.GenerateFromPassword([]byte(secret), passwordCost)
+		if err != nil {
+			return err
+		}
+	}
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return errUnknownRoom
+	}
+	if r.Creator == "" || r.Creator != clientID(clientName) {
+		return errNotRoomOwner
+	}
+	r.Mode = mode
+	r.PasswordHash = hash
+	return cds.rooms.save()
+}
+
+// checkRoomOwner returns an error unless the client is the owner of the room.
+func (cds *chatDataStore) checkRoomOwner(clientName, roomName string) error {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return errUnknownRoom
+	}
+	if r.Creator == "" || r.Creator != clientID(clientName) {
+		return errNotRoomOwner
+	}
+	return nil
+}
+
+// inviteToRoom allows the invitee to join the invite only room, only the room owner can invite.
+// The invitee is notified if connected.
+func (cds *chatDataStore) inviteToRoom(clientName, roomName, invitee string) error {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return errUnknownRoom
+	}
+	if r.Creator == "" || r.Creator != clientID(clientName) {
+		return errNotRoomOwner
+	}
+	if r.Invited == nil {
+		r.Invited = make(map[clientID]bool)
+	}
+	r.Invited[clientID(invitee)] = true
+	if cl, ok := cds.clients[clientID(invitee)]; ok {
+		cds.deliver(cl.sess, newSystemMessage(roomName, fmt.Sprintf("%s invited you to #%s", clientName, roomName)))
+	}
+	return cds.rooms.save()
+}
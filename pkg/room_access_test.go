@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRoomMode(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		in     string
+		expOut roomMode
+		expErr error
+	}{
+		{in: "", expOut: modePublic},
+		{in: "public", expOut: modePublic},
+		{in: "invite", expOut: modeInvite},
+		{in: "password", expOut: modePassword},
+		{in: "secret", expErr: errInvalidRoomMode},
+	}
+	for _, tc := range tcs {
+		out, err := parseRoomMode(tc.in)
+		if out != tc.expOut || err != tc.expErr {
+			t.Errorf("%q: expected %q, %v got %q, %v", tc.in, tc.expOut, tc.expErr, out, err)
+		}
+	}
+}
+
+func TestRoomAccessModes(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rooms.json")
+	rs, err := openRoomMetaStore(path)
+	must(t, err)
+	ds := newChatDataStoreWithQueue(ioutil.Discard, defaultQueueConfig, rs)
+	anand := &memSession{name: "anand"}
+	must(t, ds.registerClient("ankur", &memSession{name: "ankur"}))
+	must(t, ds.registerClient("anand", anand))
+	ds.setNotify("anand", false)
+	ds.addClientToRoom("ankur", "invited")
+	ds.addClientToRoom("ankur", "secret")
+
+	// only the owner changes the mode, the default room has no owner.
+	if err := ds.setRoomMode("anand", "invited", modeInvite, ""); err != errNotRoomOwner {
+		t.Errorf("expected not room owner err got %v", err)
+	}
+	if err := ds.setRoomMode("ankur", metaRoom, modeInvite, ""); err != errNotRoomOwner {
+		t.Errorf("expected not room owner err got %v", err)
+	}
+
+	must(t, ds.setRoomMode("ankur", "invited", modeInvite, ""))
+	if err := ds.joinRoom("anand", "invited", ""); err != errRoomInviteOnly {
+		t.Errorf("expected invite only err got %v", err)
+	}
+	if err := ds.inviteToRoom("anand", "invited", "anand"); err != errNotRoomOwner {
+		t.Errorf("expected not room owner err got %v", err)
+	}
+	must(t, ds.inviteToRoom("ankur", "invited", "anand"))
+	msgs := anand.waitMessages(t, 1)
+	if len(msgs) == 1 && msgs[0].Body != "ankur invited you to #invited" {
+		t.Errorf("expected invite notice got %s", msgs[0].Body)
+	}
+	must(t, ds.joinRoom("anand", "invited", ""))
+
+	if err := ds.setRoomMode("ankur", "secret", modePassword, ""); err != errRoomPassword {
+		t.Errorf("expected room password err got %v", err)
+	}
+	must(t, ds.setRoomMode("ankur", "secret", modePassword, "s3cret"))
+	if err := ds.joinRoom("anand", "secret", "guess"); err != errRoomPassword {
+		t.Errorf("expected room password err got %v", err)
+	}
+	must(t, ds.joinRoom("anand", "secret", "s3cret"))
+	if ds.checkRoomAccess("", "secret") != errPrivateRoom || ds.checkRoomAccess("other", "secret") != errPrivateRoom {
+		t.Error("expected private room to be closed to non members")
+	}
+	if ds.checkRoomAccess("anand", "secret") != nil || ds.checkRoomAccess("ankur", "invited") != nil {
+		t.Error("expected private rooms to be open to members and owner")
+	}
+	if ds.checkRoomAccess("", metaRoom) != nil || ds.checkRoomAccess("", "unknown") != nil {
+		t.Error("expected public rooms to be open to anyone")
+	}
+
+	// the password is stored hashed, and the secrets are not exposed.
+	data, err := ioutil.ReadFile(path)
+	must(t, err)
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Error("expected password to be stored hashed")
+	}
+	r, _ := ds.roomMetadata("secret")
+	if r.PasswordHash != nil || r.Mode != modePassword {
+		t.Errorf("unexpected room metadata %+v", r)
+	}
+
+	// the modes survive restarts.
+	must(t, ds.rooms.sync())
+	rs, err = openRoomMetaStore(path)
+	must(t, err)
+	ds = newChatDataStoreWithQueue(ioutil.Discard, defaultQueueConfig, rs)
+	must(t, ds.registerClient("anand", &memSession{name: "anand"}))
+	must(t, ds.registerClient("ankuranand", &memSession{name: "ankuranand"}))
+	must(t, ds.joinRoom("anand", "invited", ""))
+	if err := ds.joinRoom("ankuranand", "invited", ""); err != errRoomInviteOnly {
+		t.Errorf("expected invite only err got %v", err)
+	}
+	must(t, ds.joinRoom("ankuranand", "secret", "s3cret"))
+}
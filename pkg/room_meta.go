@@ -0,0 +1,260 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errUnknownRoom = errors.New("unknown room")
+
+// roomMeta is the information kept for each room, it outlives the room members once something is set for it.
+type roomMeta struct {
+	Name        roomID    `json:"name"`
+	Topic       string    `json:"topic"`
+	Description string    `json:"description"`
+	Creator     clientID  `json:"creator,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Mode        roomMode  `json:"mode,omitempty"`
+	// PasswordHash is the bcrypt hash of the password of the password protected room.
+	PasswordHash []byte `json:"password_hash,omitempty"`
+	// Invited are the clients allowed to join the invite only room.
+	Invited map[clientID]bool `json:"invited,omitempty"`
+	// Operators are the clients allowed to moderate the room along with the creator, the room owner.
+	Operators map[clientID]bool `json:"operators,omitempty"`
+	// Bans are the clients banned from the room until the time, zero time bans forever.
+	Bans map[clientID]time.Time `json:"bans,omitempty"`
+	// Muted are the members whose messages are not delivered to the room.
+	Muted map[clientID]bool `json:"muted,omitempty"`
+}
+
+// public returns a copy of the room metadata without the room secrets.
+func (r roomMeta) public() roomMeta {
+	r.PasswordHash = nil
+	r.Invited = nil
+	if r.Mode == "" {
+		r.Mode = modePublic
+	}
+	// copy the maps, so that the returned metadata can be read without the lock.
+	if r.Operators != nil {
+		ops := make(map[clientID]bool, len(r.Operators))
+		for cid, ok := range r.Operators {
+			ops[cid] = ok
+		}
+		r.Operators = ops
+	}
+	if r.Bans != nil {
+		bans := make(map[clientID]time.Time, len(r.Bans))
+		for cid, until := range r.Bans {
+			bans[cid] = until
+		}
+		r.Bans = bans
+	}
+	if r.Muted != nil {
+		muted := make(map[clientID]bool, len(r.Muted))
+		for cid, ok := range r.Muted {
+			muted[cid] = ok
+		}
+		r.Muted = muted
+	}
+	return r
+}
+
+// roomMetaStore holds the metadata of every room, persisted to the JSON file at path.
+// An empty path keeps the metadata in memory only.
+// It is guarded by the chatDataStore lock, the file is written out of it.
+type roomMetaStore struct {
+	path  string
+	rooms map[roomID]*roomMeta
+
+	pmu     sync.Mutex // guards the below persistence state.
+	pcond   *sync.Cond // signaled once the writes are done.
+	pending []byte     // the latest snapshot of the rooms not written yet.
+	writing bool
+	err     error // of the last write.
+}
+
+func newRoomMetaStore() *roomMetaStore {
+	rs := &roomMetaStore{rooms: make(map[roomID]*roomMeta)}
+	rs.pcond = sync.NewCond(&rs.pmu)
+	return rs
+}
+
+// openRoomMetaStore loads the rooms metadata persisted at path.
+func openRoomMetaStore(path string) (*roomMetaStore, error) {
+	rs := newRoomMetaStore()
+	rs.path = path
+	if path == "" {
+		return rs, nil
+	}
+	var rooms []*roomMeta
+	err := loadJSONFile(path, &rooms)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rooms {
+		rs.rooms[r.Name] = r
+	}
+	return rs, nil
+}
+
+// get returns the metadata of the room.
+func (rs *roomMetaStore) get(room roomID) (*roomMeta, bool) {
+	r, ok := rs.rooms[room]
+	return r, ok
+}
+
+// create adds the metadata of the room if it's not already present,
+// it reports whether the room was created.
+func (rs *roomMetaStore) create(room roomID, creator clientID) bool {
+	if _, ok := rs.rooms[room]; ok {
+		return false
+	}
+	rs.rooms[room] = &roomMeta{Name: room, Creator: creator, CreatedAt: time.Now().UTC()}
+	return true
+}
+
+// remove deletes the metadata of the room.
+func (rs *roomMetaStore) remove(room roomID) {
+	delete(rs.rooms, room)
+}
+
+// save persists the metadata of all the rooms. The snapshot taken is written in the
+// background, so that the chat doesn't wait for the disk, the snapshots taken in the
+// meantime replace it.
+func (rs *roomMetaStore) save() error {
+	if rs.path == "" {
+		return nil
+	}
+	rooms := make([]*roomMeta, 0, len(rs.rooms))
+	for _, r := range rs.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	data, err := json.MarshalIndent(rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+	rs.pmu.Lock()
+	defer rs.pmu.Unlock()
+	rs.pending = data
+	if !rs.writing {
+		rs.writing = true
+		go rs.persist()
+	}
+	return nil
+}
+
+// persist writes the snapshots saved until none is pending.
+func (rs *roomMetaStore) persist() {
+	rs.pmu.Lock()
+	defer rs.pmu.Unlock()
+	for rs.pending != nil {
+		data := rs.pending
+		rs.pending = nil
+		rs.pmu.Unlock()
+		err := writeFileAtomic(rs.path, data)
+		if err != nil {
+			log.Printf("unable to save the rooms metadata, err: %v\n", err)
+		}
+		rs.pmu.Lock()
+		rs.err = err
+	}
+	rs.writing = false
+	rs.pcond.Broadcast()
+}
+
+// sync waits for the snapshots saved to be written, it returns the error of the last write.
+func (rs *roomMetaStore) sync() error {
+	rs.pmu.Lock()
+	defer rs.pmu.Unlock()
+	for rs.writing {
+		rs.pcond.Wait()
+	}
+	return rs.err
+}
+
+// createRoomMeta adds the metadata of the room created by the client, if the room is new.
+// It must be called with the lock held.
+func (cds *chatDataStore) createRoomMeta(roomId roomID, creator clientID) {
+	if !cds.rooms.create(roomId, creator) {
+		return
+	}
+	err := cds.rooms.save()
+	if err != nil {
+		log.Printf("unable to save the rooms metadata, err: %v\n", err)
+	}
+}
+
+// pruneRoomMeta deletes the metadata of the room left empty if nothing was set for it,
+// so that joining made up rooms doesn't grow the rooms file.
+// It must be called with the lock held.
+func (cds *chatDataStore) pruneRoomMeta(roomId roomID) {
+	r, ok := cds.rooms.get(roomId)
+	if !ok || !r.implicit() {
+		return
+	}
+	cds.rooms.remove(roomId)
+	err := cds.rooms.save()
+	if err != nil {
+		log.Printf("unable to save the rooms metadata, err: %v\n", err)
+	}
+}
+
+// implicit returns true if the room was only created by joining it, nothing was set for it since.
+func (r *roomMeta) implicit() bool {
+	return r.Topic == "" && r.Description == "" && (r.Mode == "" || r.Mode == modePublic) &&
+		len(r.Invited) == 0 && len(r.Operators) == 0 && len(r.Bans) == 0 && len(r.Muted) == 0
+}
+
+// roomMetadata returns a copy of the room metadata without the room secrets.
+func (cds *chatDataStore) roomMetadata(roomName string) (roomMeta, bool) {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return roomMeta{}, false
+	}
+	return r.public(), true
+}
+
+// updateRoomMeta changes the topic and the description of the room, nil values are left unchanged.
+// A topic change is announced to the room on behalf of the client by.
+func (cds *chatDataStore) updateRoomMeta(roomName, by string, topic, description *string) (roomMeta, error) {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	roomId := roomID(roomName)
+	r, ok := cds.rooms.get(roomId)
+	if !ok {
+		return roomMeta{}, errUnknownRoom
+	}
+	if description != nil {
+		r.Description = *description
+	}
+	if topic != nil && *topic != r.Topic {
+		r.Topic = *topic
+		body := fmt.Sprintf("topic changed to: %s", r.Topic)
+		if by != "" {
+			body = fmt.Sprintf("%s changed the topic to: %s", by, r.Topic)
+		}
+		cds.notifyRoom(roomId, newSystemMessage(roomName, body))
+	}
+	return r.public(), cds.rooms.save()
+}
+
+// notifyRoom delivers the message to every member and watcher of the room.
+// It must be called with the lock held.
+func (cds *chatDataStore) notifyRoom(roomId roomID, m chatMessage) {
+	for _, sess := range cds.roomsSubscribers[roomId] {
+		cds.deliver(sess, m)
+	}
+	for sess := range cds.roomsWatchers[roomId] {
+		cds.deliver(sess, m)
+	}
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoomMetaPersisted(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rooms.json")
+
+	rs, err := openRoomMetaStore(path)
+	must(t, err)
+	ds := newChatDataStoreWithQueue(ioutil.Discard, defaultQueueConfig, rs)
+	ankur := &memSession{name: "ankur"}
+	anand := &memSession{name: "anand"}
+	must(t, ds.registerClient("ankur", ankur))
+	must(t, ds.registerClient("anand", anand))
+	ds.setNotify("ankur", false)
+	ds.setNotify("anand", false)
+	ds.addClientToRoom("ankur", "roomname")
+	ds.addClientToRoom("anand", "roomname")
+
+	topic, description := "release on friday", "release planning"
+	_, err = ds.updateRoomMeta("roomname", "ankur", &topic, &description)
+	must(t, err)
+	for _, sess := range []*memSession{ankur, anand} {
+		msgs := sess.waitMessages(t, 1)
+		if len(msgs) == 1 && msgs[0].Body != "ankur changed the topic to: release on friday" {
+			t.Errorf("expected topic notice got %s", msgs[0].Body)
+		}
+	}
+	if _, err := ds.updateRoomMeta("unknown", "ankur", &topic, nil); err != errUnknownRoom {
+		t.Errorf("expected unknown room err got %v", err)
+	}
+
+	// the metadata outlives the room members and the restarts.
+	ds.deleteClient("ankur")
+	ds.deleteClient("anand")
+	// the metadata is written in the background.
+	must(t, ds.rooms.sync())
+	rs, err = openRoomMetaStore(path)
+	must(t, err)
+	ds = newChatDataStoreWithQueue(ioutil.Discard, defaultQueueConfig, rs)
+	r, ok := ds.roomMetadata("roomname")
+	if !ok {
+		t.Fatal("expected roomname metadata to be loaded")
+	}
+	if r.Topic != topic || r.Description != description || r.Creator != "ankur" || r.CreatedAt.IsZero() {
+		t.Errorf("unexpected loaded room metadata %+v", r)
+	}
+	if _, ok := ds.roomMetadata(metaRoom); !ok {
+		t.Error("expected default room metadata")
+	}
+}
+
+func TestRoomMetaPruned(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	must(t, ds.registerClient("ankur", &memSession{name: "ankur"}))
+	ds.setNotify("ankur", false)
+	ds.addClientToRoom("ankur", "madeup")
+	ds.addClientToRoom("ankur", "roomname")
+	topic := "release on friday"
+	_, err := ds.updateRoomMeta("roomname", "ankur", &topic, nil)
+	must(t, err)
+
+	// the metadata of the rooms left empty is kept only if something was set for them.
+	ds.deleteClient("ankur")
+	if _, ok := ds.roomMetadata("madeup"); ok {
+		t.Error("expected madeup metadata to be pruned")
+	}
+	if _, ok := ds.roomMetadata("roomname"); !ok {
+		t.Error("expected roomname metadata to be kept")
+	}
+	if _, ok := ds.roomMetadata(metaRoom); !ok {
+		t.Error("expected default room metadata to be kept")
+	}
+}
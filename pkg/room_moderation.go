@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	errNotRoomOperator = errors.New("not a room operator")
+	errBannedFromRoom  = errors.New("banned from room")
+	errMutedInRoom     = errors.New("muted in room")
+	errModerateOwner   = errors.New("cannot moderate the room owner")
+)
+
+// isModerator returns true if the client is the room owner or one of its operators.
+func (r *roomMeta) isModerator(cid clientID) bool {
+	return (r.Creator != "" && r.Creator == cid) || r.Operators[cid]
+}
+
+// isBanned returns true if the client is banned from the room at the time.
+func (r *roomMeta) isBanned(cid clientID, now time.Time) bool {
+	until, ok := r.Bans[cid]
+	return ok && (until.IsZero() || now.Before(until))
+}
+
+// canSend returns the reason the client messages are not delivered to the room, if any.
+func (r *roomMeta) canSend(cid clientID, now time.Time) error {
+	if r.isBanned(cid, now) {
+		return errBannedFromRoom
+	}
+	if r.Muted[cid] {
+		return errMutedInRoom
+	}
+	return nil
+}
+
+// checkSend returns the reason the client messages are not delivered to the room, if any.
+func (cds *chatDataStore) checkSend(clientName, roomName string) error {
+	cds.lock.RLock()
+	defer cds.lock.RUnlock()
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return nil
+	}
+	return r.canSend(clientID(clientName), time.Now())
+}
+
+// moderate runs the moderation action fn of the client by on the target in the room,
+// once checked that by is allowed to moderate the target. The room metadata is saved after.
+// It must be called with the lock held.
+func (cds *chatDataStore) moderate(by, roomName, target string, fn func(r *roomMeta, cid clientID)) error {
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return errUnknownRoom
+	}
+	if !r.isModerator(clientID(by)) {
+		return errNotRoomOperator
+	}
+	cid := clientID(target)
+	if cid == r.Creator {
+		return errModerateOwner
+	}
+	fn(r, cid)
+	return cds.rooms.save()
+}
+
+// expel removes the client from the room and tells it the reason. A client expelled
+// from its last room is moved to the meta room, so that it's always part of a room.
+// It must be called with the lock held.
+func (cds *chatDataStore) expel(cid clientID, roomId roomID, reason string) {
+	if _, ok := cds.roomsSubscribers[roomId][cid]; !ok {
+		return
+	}
+	cds.leaveRoom(cid, roomId)
+	cl, ok := cds.clients[cid]
+	if !ok {
+		return
+	}
+	cds.deliver(cl.sess, newSystemMessage(string(roomId), reason))
+	for _, roomM := range cds.roomsSubscribers {
+		if _, ok := roomM[cid]; ok {
+			return
+		}
+	}
+	cds.enterRoom(cid, metaRoom)
+}
+
+// kickFromRoom removes the target client from the room.
+func (cds *chatDataStore) kickFromRoom(by, roomName, target string) error {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	if _, ok := cds.roomsSubscribers[roomID(roomName)][clientID(target)]; !ok {
+		return errNotRoomMember
+	}
+	return cds.moderate(by, roomName, target, func(r *roomMeta, cid clientID) {
+		cds.expel(cid, r.Name, fmt.Sprintf("you were kicked from #%s by %s", r.Name, by))
+		cds.notifyRoom(r.Name, newSystemMessage(roomName, fmt.Sprintf("%s was kicked by %s", cid, by)))
+	})
+}
+
+// banFromRoom removes the target client from the room and keeps it out for the duration,
+// a zero duration bans forever.
+func (cds *chatDataStore) banFromRoom(by, roomName, target string, d time.Duration) error {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	return cds.moderate(by, roomName, target, func(r *roomMeta, cid clientID) {
+		var until time.Time
+		how := "forever"
+		if d > 0 {
+			until = time.Now().UTC().Add(d)
+			how = "for " + d.String()
+		}
+		if r.Bans == nil {
+			r.Bans = make(map[clientID]time.Time)
+		}
+		r.Bans[cid] = until
+		cds.expel(cid, r.Name, fmt.Sprintf("you were banned from #%s by %s %s", r.Name, by, how))
+		cds.notifyRoom(r.Name, newSystemMessage(roomName, fmt.Sprintf("%s was banned by %s %s", cid, by, how)))
+	})
+}
+
+// unbanFromRoom lifts the ban of the target client.
+func (cds *chatDataStore) unbanFromRoom(by, roomName, target string) error {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	return cds.moderate(by, roomName, target, func(r *roomMeta, cid clientID) {
+		delete(r.Bans, cid)
+	})
+}
+
+// releaseRoomRoles drops the owner and operator roles held by the released clients in every room.
+// The names not registered can be taken by anyone once freed, their roles are released so that
+// the next client taking the name doesn't inherit them.
+func (cds *chatDataStore) releaseRoomRoles(released func(cid clientID) bool) {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	changed := false
+	for _, r := range cds.rooms.rooms {
+		if r.Creator != "" && released(r.Creator) {
+			r.Creator = ""
+			changed = true
+		}
+		for cid := range r.Operators {
+			if released(cid) {
+				delete(r.Operators, cid)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	err := cds.rooms.save()
+	if err != nil {
+		log.Printf("unable to save the rooms metadata, err: %v\n", err)
+	}
+}
+
+// setRoomOperator grants or revokes the operator role of the target client, only the room owner can do it.
+func (cds *chatDataStore) setRoomOperator(by, roomName, target string, op bool) error {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	r, ok := cds.rooms.get(roomID(roomName))
+	if !ok {
+		return errUnknownRoom
+	}
+	if r.Creator == "" || r.Creator != clientID(by) {
+		return errNotRoomOwner
+	}
+	return cds.moderate(by, roomName, target, func(r *roomMeta, cid clientID) {
+		if !op {
+			delete(r.Operators, cid)
+			cds.notifyRoom(r.Name, newSystemMessage(roomName, fmt.Sprintf("%s is no longer an operator", cid)))
+			return
+		}
+		if r.Operators == nil {
+			r.Operators = make(map[clientID]bool)
+		}
+		r.Operators[cid] = true
+		cds.notifyRoom(r.Name, newSystemMessage(roomName, fmt.Sprintf("%s is now an operator", cid)))
+	})
+}
+
+// muteInRoom stops or resumes delivering the target client messages to the room.
+func (cds *chatDataStore) muteInRoom(by, roomName, target string, mute bool) error {
+	cds.lock.Lock()
+	defer cds.lock.Unlock()
+	return cds.moderate(by, roomName, target, func(r *roomMeta, cid clientID) {
+		if !mute {
+			delete(r.Muted, cid)
+			cds.notifyRoom(r.Name, newSystemMessage(roomName, fmt.Sprintf("%s was unmuted by %s", cid, by)))
+			return
+		}
+		if r.Muted == nil {
+			r.Muted = make(map[clientID]bool)
+		}
+		r.Muted[cid] = true
+		cds.notifyRoom(r.Name, newSystemMessage(roomName, fmt.Sprintf("%s was muted by %s", cid, by)))
+	})
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hasBody returns true if one of the messages has the body.
+func hasBody(msgs []chatMessage, body string) bool {
+	for _, m := range msgs {
+		if m.Body == body {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoomModeration(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rooms.json")
+	rs, err := openRoomMetaStore(path)
+	must(t, err)
+	ds := newChatDataStoreWithQueue(ioutil.Discard, defaultQueueConfig, rs)
+	ankur := &memSession{name: "ankur"}
+	ankuranand := &memSession{name: "ankuranand"}
+	must(t, ds.registerClient("ankur", ankur))
+	must(t, ds.registerClient("anand", &memSession{name: "anand"}))
+	must(t, ds.registerClient("ankuranand", ankuranand))
+	ds.addClientToRoom("ankur", "ops")
+	must(t, ds.joinRoom("anand", "ops", ""))
+	must(t, ds.joinRoom("ankuranand", "ops", ""))
+	ds.removeClientFromRoom("ankuranand", metaRoom)
+
+	// only the owner and the operators moderate, the owner can't be moderated.
+	if err := ds.kickFromRoom("anand", "ops", "ankuranand"); err != errNotRoomOperator {
+		t.Errorf("expected not room operator err got %v", err)
+	}
+	if err := ds.setRoomOperator("anand", "ops", "anand", true); err != errNotRoomOwner {
+		t.Errorf("expected not room owner err got %v", err)
+	}
+	must(t, ds.setRoomOperator("ankur", "ops", "anand", true))
+	if err := ds.kickFromRoom("anand", "ops", "ankur"); err != errModerateOwner {
+		t.Errorf("expected moderate owner err got %v", err)
+	}
+
+	// the kicked client is moved to the meta room, once it's not part of any room.
+	must(t, ds.kickFromRoom("anand", "ops", "ankuranand"))
+	if rooms := ds.clientRooms("ankuranand"); len(rooms) != 1 || rooms[0] != metaRoom {
+		t.Errorf("expected kicked client in the default room got %v", rooms)
+	}
+	if !hasBody(ankuranand.waitMessages(t, 1), "you were kicked from #ops by anand") {
+		t.Errorf("expected kick notice got %+v", ankuranand.messages())
+	}
+	if err := ds.kickFromRoom("anand", "ops", "ankuranand"); err != errNotRoomMember {
+		t.Errorf("expected not room member err got %v", err)
+	}
+
+	must(t, ds.banFromRoom("anand", "ops", "ankuranand", 0))
+	if err := ds.joinRoom("ankuranand", "ops", ""); err != errBannedFromRoom {
+		t.Errorf("expected banned from room err got %v", err)
+	}
+	if err := ds.checkSend("ankuranand", "ops"); err != errBannedFromRoom {
+		t.Errorf("expected banned from room err got %v", err)
+	}
+	ds.broadcastMsg(context.Background(), newChatMessage("ankuranand", "ops", "from a banned client", originREST))
+
+	must(t, ds.setRoomOperator("ankur", "ops", "anand", false))
+	if err := ds.unbanFromRoom("anand", "ops", "ankuranand"); err != errNotRoomOperator {
+		t.Errorf("expected not room operator err got %v", err)
+	}
+	must(t, ds.unbanFromRoom("ankur", "ops", "ankuranand"))
+	must(t, ds.joinRoom("ankuranand", "ops", ""))
+
+	must(t, ds.muteInRoom("ankur", "ops", "ankuranand", true))
+	if err := ds.checkSend("ankuranand", "ops"); err != errMutedInRoom {
+		t.Errorf("expected muted in room err got %v", err)
+	}
+	ds.broadcastMsg(context.Background(), newChatMessage("ankuranand", "ops", "from a muted client", originTelnet))
+	must(t, ds.muteInRoom("ankur", "ops", "ankuranand", false))
+	ds.broadcastMsg(context.Background(), newChatMessage("ankuranand", "ops", "from an unmuted client", originTelnet))
+	deadline := time.Now().Add(time.Second)
+	for !hasBody(ankur.messages(), "from an unmuted client") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	msgs := ankur.messages()
+	if !hasBody(msgs, "from an unmuted client") || hasBody(msgs, "from a muted client") || hasBody(msgs, "from a banned client") {
+		t.Errorf("expected only the unmuted message delivered got %+v", msgs)
+	}
+
+	// the bans survive restarts, and expire.
+	must(t, ds.banFromRoom("ankur", "ops", "ankuranand", time.Hour))
+	must(t, ds.rooms.sync())
+	rs, err = openRoomMetaStore(path)
+	must(t, err)
+	r, ok := rs.get("ops")
+	if !ok {
+		t.Fatal("expected ops room metadata to be loaded")
+	}
+	if !r.isBanned("ankuranand", time.Now()) || r.isBanned("ankuranand", time.Now().Add(time.Hour*2)) {
+		t.Errorf("expected ankuranand banned for an hour got %v", r.Bans)
+	}
+}
+
+func TestReleaseRoomRoles(t *testing.T) {
+	t.Parallel()
+	ds := newChatDataStore(ioutil.Discard)
+	must(t, ds.registerClient("ankur", &memSession{name: "ankur"}))
+	must(t, ds.registerClient("anand", &memSession{name: "anand"}))
+	ds.addClientToRoom("ankur", "ops")
+	ds.addClientToRoom("anand", "news")
+	must(t, ds.joinRoom("anand", "ops", ""))
+	must(t, ds.setRoomOperator("ankur", "ops", "anand", true))
+	must(t, ds.setRoomOperator("anand", "news", "ankur", true))
+
+	ds.releaseRoomRoles(func(cid clientID) bool {
+		return cid == "ankur"
+	})
+	if err := ds.checkRoomOwner("ankur", "ops"); err != errNotRoomOwner {
+		t.Errorf("expected not room owner err got %v", err)
+	}
+	if err := ds.kickFromRoom("ankur", "news", "anand"); err != errNotRoomOperator {
+		t.Errorf("expected not room operator err got %v", err)
+	}
+	// the roles of the other clients are kept.
+	must(t, ds.checkRoomOwner("anand", "news"))
+	if err := ds.muteInRoom("anand", "ops", "ankur", true); err != nil {
+		t.Errorf("expected the operator to moderate got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errSessionClosed = errors.New("session closed")
+	noTimeout        = time.Time{}
+)
+
+// session is a single chat subscriber independent of its transport.
+// Each transport formats the delivered messages for itself.
+type session interface {
+	// deliver sends the message to the subscriber.
+	deliver(m chatMessage) error
+	// close closes the underlying transport of the subscriber.
+	close() error
+	// remoteIdentity identifies the remote end of the subscriber.
+	remoteIdentity() string
+}
+
+// connSession is a session over a net.Conn that writes each message
+// formatted by its format func.
+type connSession struct {
+	conn   net.Conn
+	format func(m chatMessage) []byte
+}
+
+func newConnSession(conn net.Conn, format func(m chatMessage) []byte) *connSession {
+	return &connSession{conn: conn, format: format}
+}
+
+// newTelnetSession returns a session that writes messages in terminal format,
+// rendered by the current renderer of the conn.
+func newTelnetSession(conn net.Conn) *connSession {
+	return newConnSession(conn, func(m chatMessage) []byte {
+		r := render(conn)
+		switch m.Kind {
+		case kindSystem:
+			return []byte(r.system(m.Room, m.Body))
+		case kindDirect:
+			return []byte(r.private(m.Timestamp, string(m.Sender), m.Body))
+		}
+		return []byte(r.message(m.Timestamp, string(m.Sender), string(m.Room), m.Body))
+	})
+}
+
+// newJSONSession returns a session that writes messages as JSON records.
+func newJSONSession(conn net.Conn) *connSession {
+	return newConnSession(conn, func(m chatMessage) []byte {
+		b, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("unable to marshal message, err: %v\n", err)
+		}
+		return b
+	})
+}
+
+func (cs *connSession) deliver(m chatMessage) error {
+	err := cs.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// reuse write conn.
+		err := cs.conn.SetWriteDeadline(noTimeout)
+		if err != nil {
+			log.Printf("SetWriteDeadline failed: %v\n", err)
+		}
+	}()
+	_, err = cs.conn.Write(cs.format(m))
+	return err
+}
+
+func (cs *connSession) close() error {
+	return cs.conn.Close()
+}
+
+func (cs *connSession) remoteIdentity() string {
+	return cs.conn.RemoteAddr().String()
+}
+
+// streamSession is a session that buffers the delivered messages in a channel
+// for the consumer to read from, like a live Server-Sent Events stream.
+type streamSession struct {
+	remote string
+	msgs   chan chatMessage
+	once   sync.Once
+	done   chan struct{}
+	lock   sync.RWMutex // guards send on msgs against its close.
+}
+
+func newStreamSession(remote string, size int) *streamSession {
+	return &streamSession{
+		remote: remote,
+		msgs:   make(chan chatMessage, size),
+		done:   make(chan struct{}),
+	}
+}
+
+// deliver buffers the message, messages are dropped when the buffer is full
+// rather than blocking the sender.
+func (ss *streamSession) deliver(m chatMessage) error {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	select {
+	case <-ss.done:
+		return errSessionClosed
+	default:
+	}
+	select {
+	case ss.msgs <- m:
+		return nil
+	default:
+		return errors.New("stream buffer full")
+	}
+}
+
+// close closes the messages channel, it is safe to be called multiple times.
+func (ss *streamSession) close() error {
+	ss.once.Do(func() {
+		ss.lock.Lock()
+		defer ss.lock.Unlock()
+		close(ss.done)
+		close(ss.msgs)
+	})
+	return nil
+}
+
+func (ss *streamSession) remoteIdentity() string {
+	return ss.remote
+}
@@ -0,0 +1,395 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errUnauthorizedKey = errors.New("public key not authorized")
+	errInvalidSSHUser  = errors.New("invalid ssh user name")
+	errNoSSHHostKey    = errors.New("ssh_host_key_file is not configured")
+)
+
+// sshConn adapts an ssh session channel with a PTY to the net.Conn line protocol used by the telnetHandler.
+// The client terminal is in raw mode, so the reads edit the typed line, echoing it, and return
+// the line once entered. The writes redraw the partial line below the text written, and end
+// the lines with CR LF. Ctrl-C and Ctrl-D end the session.
+type sshConn struct {
+	nc   net.Conn // of the ssh connection, for its addresses.
+	ch   ssh.Channel
+	user string
+	renderSetting
+
+	// the deadlines of the channel, the ones of the nc are shared by all its channels.
+	rdl, wdl channelDeadline
+
+	wmu sync.Mutex // guards the below line editor, and the writes against the echo.
+	ed  lineEditor
+
+	// only used by the reader.
+	rbuf  []byte
+	lines []byte // read, but not returned yet.
+}
+
+func newSSHConn(nc net.Conn, user string, ch ssh.Channel) *sshConn {
+	c := &sshConn{nc: nc, ch: ch, user: user, rbuf: make([]byte, 1024)}
+	c.rdl.ch = ch
+	c.wdl.ch = ch
+	return c
+}
+
+// channelDeadline closes the channel once the deadline passes, which unblocks
+// its reads and writes. The ssh channels have no deadlines of their own.
+type channelDeadline struct {
+	ch ssh.Channel
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+}
+
+// set arms the deadline at t, the zero t disarms it.
+func (d *channelDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	d.timer = time.AfterFunc(time.Until(t), d.expire)
+}
+
+func (d *channelDeadline) expire() {
+	d.mu.Lock()
+	d.expired = true
+	d.mu.Unlock()
+	err := d.ch.Close()
+	if err != nil && err != io.EOF {
+		log.Printf("unable to close the ssh channel past its deadline, err: %v\n", err)
+	}
+}
+
+// err returns os.ErrDeadlineExceeded in place of the err of the channel closed past the deadline.
+func (d *channelDeadline) err(err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil && d.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// Read returns the lines entered by the client.
+func (c *sshConn) Read(p []byte) (int, error) {
+	for len(c.lines) == 0 {
+		n, err := c.ch.Read(c.rbuf)
+		err = c.rdl.err(err)
+		lines, quit := c.edit(c.rbuf[:n])
+		c.lines = append(c.lines, lines...)
+		if quit {
+			err = io.EOF
+		}
+		if err != nil {
+			n := copy(p, c.lines)
+			c.lines = c.lines[n:]
+			return n, err
+		}
+	}
+	n := copy(p, c.lines)
+	c.lines = c.lines[n:]
+	return n, nil
+}
+
+// edit feeds the typed keys to the line editor and echoes them.
+// It returns the lines entered, and true once the client quit.
+func (c *sshConn) edit(data []byte) ([]byte, bool) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var lines, echo []byte
+	quit := false
+	r := c.renderer()
+	for _, b := range data {
+		if b == keyCtrlC || b == keyCtrlD {
+			quit = true
+			break
+		}
+		e, line, entered := c.ed.feed(b, r)
+		echo = append(echo, e...)
+		if entered {
+			lines = append(lines, line...)
+			lines = append(lines, '\r', '\n')
+		}
+	}
+	if len(echo) != 0 {
+		_, err := c.ch.Write(echo)
+		if err != nil {
+			log.Println("ssh echo write failed, err: ", err)
+		}
+	}
+	return lines, quit
+}
+
+// Write writes p to the client, redrawing the line being typed below it.
+func (c *sshConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// the PTY doesn't translate the new lines, the text is written for the telnet clients.
+	text := strings.ReplaceAll(string(p), "\n", "\r\n")
+	_, err := io.WriteString(c.ch, c.ed.redraw(text, c.renderer()))
+	if err != nil {
+		return 0, c.wdl.err(err)
+	}
+	return len(p), nil
+}
+
+// setColumns sets the width of the client window, the typed lines wrap over its rows.
+func (c *sshConn) setColumns(cols int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.ed.cols = cols
+}
+
+// Close ends the session with a success exit status, and closes the channel.
+func (c *sshConn) Close() error {
+	c.rdl.set(time.Time{})
+	c.wdl.set(time.Time{})
+	_, err := c.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	if err != nil && err != io.EOF {
+		log.Printf("unable to send ssh exit status, err: %v\n", err)
+	}
+	return c.ch.Close()
+}
+
+func (c *sshConn) LocalAddr() net.Addr {
+	return c.nc.LocalAddr()
+}
+
+func (c *sshConn) RemoteAddr() net.Addr {
+	return c.nc.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the channel.
+// Unlike the net.Conn ones, the channel is closed once a deadline passes.
+func (c *sshConn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
+	return nil
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
+	return nil
+}
+
+// setEcho masks the typed line, like a password, when on is false.
+func (c *sshConn) setEcho(on bool) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.ed.masked = !on
+	return nil
+}
+
+// identity returns the ssh user name, authenticated by its public key.
+func (c *sshConn) identity() string {
+	return c.user
+}
+
+// sshHandler serves the ssh clients with the same command loop as the telnet connection's.
+// The clients are authenticated by their public key listed in the authorized_keys file,
+// with the ssh user name as its comment, and chat with it as their name.
+type sshHandler struct {
+	config         *ssh.ServerConfig
+	authorizedKeys string
+	telnetHandler  *telnetHandler
+}
+
+func newSSHHandler(th *telnetHandler, hostKey ssh.Signer, authorizedKeys string) *sshHandler {
+	sh := &sshHandler{authorizedKeys: authorizedKeys, telnetHandler: th}
+	sh.config = &ssh.ServerConfig{PublicKeyCallback: sh.authenticate}
+	sh.config.AddHostKey(hostKey)
+	return sh
+}
+
+// authenticate accepts the public keys authorized for the user.
+// The user names that can't be a chat name are refused.
+func (sh *sshHandler) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if !validSSHUser(meta.User()) {
+		return nil, errInvalidSSHUser
+	}
+	ok, err := authorizedKey(sh.authorizedKeys, meta.User(), key)
+	if err != nil {
+		log.Printf("unable to read the ssh authorized keys, err: %v\n", err)
+		return nil, errUnauthorizedKey
+	}
+	if !ok {
+		return nil, errUnauthorizedKey
+	}
+	return nil, nil
+}
+
+// validSSHUser returns true if the user name is not blank, and has no control characters.
+func validSSHUser(user string) bool {
+	if strings.TrimSpace(user) == "" || !utf8.ValidString(user) {
+		return false
+	}
+	for _, r := range user {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizedKey returns true if the key is listed in the authorized_keys file at path with
+// the user as its comment. The keys without comment are skipped, they authorize nobody.
+// The file is read on each login, so that the keys added or removed apply to a running server.
+func authorizedKey(path, user string, key ssh.PublicKey) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	want := key.Marshal()
+	for len(b) != 0 {
+		// the invalid lines are skipped, an error means no more keys.
+		pk, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		b = rest
+		if comment == "" {
+			continue
+		}
+		if comment == user && bytes.Equal(pk.Marshal(), want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// loadHostKey loads the ssh host key at path, it generates an ed25519 key
+// and persists it there if missing.
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		err = ioutil.WriteFile(path, b, 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("generated the ssh host key %s\n", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// serveConn serves the ssh connection, each session channel with a PTY is a chat client.
+func (sh *sshHandler) serveConn(nc net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(nc, sh.config)
+	if err != nil {
+		log.Printf("ssh handshake failed, remoteAddr: %s, err: %v\n", nc.RemoteAddr(), err)
+		err = nc.Close()
+		if err != nil {
+			log.Printf("unable to close ssh connection, error: %s\n", err)
+		}
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			err := nch.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			if err != nil {
+				log.Printf("unable to reject ssh channel, err: %v\n", err)
+			}
+			continue
+		}
+		ch, chReqs, err := nch.Accept()
+		if err != nil {
+			log.Printf("unable to accept ssh channel, err: %v\n", err)
+			continue
+		}
+		go sh.serveChannel(newSSHConn(nc, sconn.User(), ch), chReqs)
+	}
+}
+
+// ptyRequest is the payload of the "pty-req" request, RFC 4254 section 6.2.
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// serveChannel answers the requests of the session channel, and serves the chat once the
+// client asks for a shell. The clients without a PTY are refused, the chat needs the raw input.
+func (sh *sshHandler) serveChannel(conn *sshConn, reqs <-chan *ssh.Request) {
+	pty := false
+	for req := range reqs {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			var pr ptyRequest
+			if ssh.Unmarshal(req.Payload, &pr) == nil {
+				pty, ok = true, true
+				conn.setRenderer(rendererForTerm(pr.Term))
+				conn.setColumns(int(pr.Columns))
+			}
+		case "shell":
+			ok = pty
+			if !ok {
+				_, _ = io.WriteString(conn.ch.Stderr(), "a terminal is required, connect with ssh -t\r\n")
+			}
+		}
+		if req.WantReply {
+			err := req.Reply(ok, nil)
+			if err != nil {
+				log.Printf("unable to reply ssh request, err: %v\n", err)
+			}
+		}
+		if req.Type != "shell" {
+			continue
+		}
+		// the requests sent during the chat, like the window changes, are not needed.
+		go ssh.DiscardRequests(reqs)
+		if !ok {
+			_ = conn.Close()
+			return
+		}
+		sh.telnetHandler.serveSession(conn, newTelnetSession(conn), originSSH)
+		return
+	}
+}
@@ -0,0 +1,260 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHTestServer starts the ssh listener of a chat server authorizing the key for ankur.
+func newSSHTestServer(t *testing.T, key ssh.Signer) (*ChatServer, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	keys := filepath.Join(dir, "authorized_keys")
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey()))) + " ankur\n"
+	must(t, ioutil.WriteFile(keys, []byte("# chat users\ninvalid line\n"+line), 0644))
+	cs, err := NewChatServer(Config{
+		LogFile:               filepath.Join(dir, "telchat.log"),
+		SSHHostKeyFile:        filepath.Join(dir, "ssh_host_key"),
+		SSHAuthorizedKeysFile: keys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the host key generated is reused.
+	if _, err := NewChatServer(Config{LogFile: filepath.Join(dir, "telchat.log"), SSHHostKeyFile: filepath.Join(dir, "ssh_host_key")}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cs.serveListener(l, cs.sshHandler.serveConn)
+	return cs, l.Addr().String()
+}
+
+func newSSHTestKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dialSSH connects the ssh client of the user, the connection times out after 2 seconds.
+func dialSSH(addr, user string, key ssh.Signer) (*ssh.Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(time.Second * 2))
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// startSSHShell opens a shell session with a PTY of the term type.
+func startSSHShell(t *testing.T, client *ssh.Client, term string) (io.Writer, *bufio.Reader) {
+	t.Helper()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sess.Close()
+	})
+	must(t, sess.RequestPty(term, 24, 80, ssh.TerminalModes{}))
+	in, err := sess.StdinPipe()
+	must(t, err)
+	out, err := sess.StdoutPipe()
+	must(t, err)
+	must(t, sess.Shell())
+	return in, bufio.NewReader(out)
+}
+
+func TestSSHHandler(t *testing.T) {
+	t.Parallel()
+	key := newSSHTestKey(t)
+	cs, addr := newSSHTestServer(t, key)
+
+	// the key is only authorized for its user, and the other keys are refused.
+	if _, err := dialSSH(addr, "anand", key); err == nil {
+		t.Error("expected the key of ankur to be refused for anand")
+	}
+	if _, err := dialSSH(addr, "ankur", newSSHTestKey(t)); err == nil {
+		t.Error("expected the unknown key to be refused")
+	}
+
+	client, err := dialSSH(addr, "ankur", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the ssh user chats with its name, without being asked.
+	in, r := startSSHShell(t, client, "xterm-256color")
+	readUntil(t, r, "Thanks for Joining!")
+	readUntil(t, r, "\u001b[35mankur\u001b[0m: \u001b[34m[default]")
+	_, err = io.WriteString(in, "/room whx\x7fo\r")
+	must(t, err)
+	// the typed keys are echoed, and the lines end with CR LF.
+	readUntil(t, r, "/room whx\b \bo\r\n")
+	readUntil(t, r, "1 members: \u001b[35mankur\u001b[0m\r\n")
+
+	// a telnet client chats with the ssh client.
+	conn, tr := dialTelnet(t, cs, "anand")
+	defer conn.Close()
+	readUntil(t, tr, "[default]")
+	_, err = conn.Write([]byte("hi ankur\r\n"))
+	must(t, err)
+	readUntil(t, r, "hi ankur")
+
+	// a second session of the same user is refused.
+	client2, err := dialSSH(addr, "ankur", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+	_, r2 := startSSHShell(t, client2, "dumb")
+	readUntil(t, r2, "name ankur Taken")
+
+	// Ctrl-D ends the session.
+	_, err = io.WriteString(in, "\x04")
+	must(t, err)
+	readUntil(t, tr, "ankur left #default")
+}
+
+func TestSSHHandlerRequiresPty(t *testing.T) {
+	t.Parallel()
+	key := newSSHTestKey(t)
+	_, addr := newSSHTestServer(t, key)
+	client, err := dialSSH(addr, "ankur", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.Shell(); err == nil {
+		t.Error("expected the shell without PTY to be refused")
+	}
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	t.Parallel()
+	key := newSSHTestKey(t)
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := filepath.Join(dir, "authorized_keys")
+	// the key without comment authorizes nobody, not even the empty user name.
+	line := string(ssh.MarshalAuthorizedKey(key.PublicKey()))
+	must(t, ioutil.WriteFile(keys, []byte(line), 0644))
+	for _, user := range []string{"", "ankur"} {
+		ok, err := authorizedKey(keys, user, key.PublicKey())
+		if err != nil || ok {
+			t.Errorf("expected the key without comment to not authorize %q got %v %v", user, ok, err)
+		}
+	}
+	must(t, ioutil.WriteFile(keys, []byte(line+strings.TrimSpace(line)+" ankur\n"), 0644))
+	if ok, err := authorizedKey(keys, "ankur", key.PublicKey()); err != nil || !ok {
+		t.Errorf("expected the key to authorize ankur got %v %v", ok, err)
+	}
+}
+
+func TestValidSSHUser(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]bool{
+		"ankur":       true,
+		"ankur anand": true,
+		"":            false,
+		"  \t":        false,
+		"ank\x1bur":   false,
+		"ankur\r\n":   false,
+		"ank\u0085ur": false,
+		"\xffankur":   false,
+	}
+	for user, valid := range tcs {
+		if got := validSSHUser(user); got != valid {
+			t.Errorf("%q: expected valid %v got %v", user, valid, got)
+		}
+	}
+}
+
+// blockingChannel is a ssh channel with a client not reading, its writes block until it's closed.
+type blockingChannel struct {
+	ssh.Channel
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *blockingChannel) Write(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *blockingChannel) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func TestSSHConnDeadline(t *testing.T) {
+	t.Parallel()
+	ch := &blockingChannel{closed: make(chan struct{})}
+	conn := newSSHConn(nil, "ankur", ch)
+
+	// a disarmed deadline doesn't close the channel.
+	must(t, conn.SetWriteDeadline(time.Now().Add(time.Millisecond*10)))
+	must(t, conn.SetWriteDeadline(time.Time{}))
+	time.Sleep(time.Millisecond * 30)
+	select {
+	case <-ch.closed:
+		t.Fatal("expected the channel to stay open")
+	default:
+	}
+
+	must(t, conn.SetWriteDeadline(time.Now().Add(time.Millisecond*20)))
+	_, err := conn.Write([]byte("hi"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the write to exceed its deadline got %v", err)
+	}
+}
@@ -18,23 +18,72 @@ type optionType uint8
 
 const (
 	writeTimeout                = 10 * time.Second
+	maxLoginAttempts            = 3
 	helpCommand                 = "/h"
 	infoCommand                 = "/info"
+	registerCommand             = "/register"
 	roomPrefix                  = "/room"
 	clientPrefix                = "/client"
+	directMsgPrefix             = "/msg"
+	notifyPrefix                = "/notify"
+	setPrefix                   = "/set"
 	clientOptionType optionType = iota
 	roomOptionType
 	msgOptionType
+	directMsgOptionType
+	notifyOptionType
+	setOptionType
 )
 
 // formatDM format's the display message that include timestamp, name of the client and msg in terminal format
 func formatDM(name, room, msg string) string {
-	return fmt.Sprintf("\n\r\033[1A\033[0K \u001b[36m%s \u001b[35m%s\u001b[0m@\u001b[34m%s\u001b[0m \u001B[33m:\u001B[0m  %s\n", time.Now().UTC().Format(time.Stamp), name, room, msg)
+	return formatDMAt(time.Now().UTC(), name, room, msg)
+}
+
+// formatDMAt format's the display message same as formatDM for the given timestamp.
+func formatDMAt(ts time.Time, name, room, msg string) string {
+	return fmt.Sprintf("\n\r \u001b[36m%s \u001b[35m%s\u001b[0m@\u001b[34m%s\u001b[0m \u001B[33m:\u001B[0m  %s\n", ts.Format(time.Stamp), name, room, msg)
+}
+
+// formatSystemMsg format's the chat server notice to the room in terminal format.
+func formatSystemMsg(room roomID, msg string) string {
+	return fmt.Sprintf("\n\r \u001B[33m***\u001B[0m \u001b[34m%s\u001b[0m \u001B[33m%s\u001B[0m\n", room, msg)
+}
+
+// formatPM format's the private message from the client in terminal format, distinct from the room messages.
+func formatPM(ts time.Time, name, msg string) string {
+	return fmt.Sprintf("\n\r \u001b[36m%s \u001b[35m%s\u001b[0m \u001B[31m(private)\u001B[0m \u001B[33m:\u001B[0m  \u001B[1m%s\u001B[0m\n", ts.Format(time.Stamp), name, msg)
 }
 
 // formatCMDErr format's the display message that indicate the command err in terminal format.
 func formatCMDErr(cmd string) string {
-	return fmt.Sprintf("\u001b[31m[Error]:\u001b[0m \u001b[34minvalid command\u001b[0m `%s`\n", cmd)
+	return formatErrMsg("invalid command", cmd)
+}
+
+// formatErrMsg format's the display message that indicate the reason the cmd failed in terminal format.
+func formatErrMsg(reason, cmd string) string {
+	return fmt.Sprintf("\u001b[31m[Error]:\u001b[0m \u001b[34m%s\u001b[0m `%s`\n", reason, cmd)
+}
+
+// formatRoomList format's the rooms with their member count in terminal format.
+func formatRoomList(rooms []roomInfo) string {
+	wr := new(bytes.Buffer)
+	w := tabwriter.NewWriter(wr, 0, 8, 4, ' ', 0)
+	fmt.Fprintf(w, " \u001B[33mROOM\tMEMBERS\u001B[0m\n\r")
+	for _, r := range rooms {
+		fmt.Fprintf(w, " \u001B[34m%s\t%d\u001B[0m\n\r", r.Name, r.Members)
+	}
+	_ = w.Flush()
+	return wr.String()
+}
+
+// formatRoomMembers format's the members of the room in terminal format.
+func formatRoomMembers(room string, members []clientID) string {
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		names = append(names, fmt.Sprintf("\u001B[35m%s\u001B[0m", m))
+	}
+	return fmt.Sprintf("\u001B[34m[%s]\u001B[0m %d members: %s\n\r", room, len(members), strings.Join(names, ", "))
 }
 
 // infoDisplay decorate the name and room information in terminal format
@@ -58,9 +107,26 @@ func disHelpCommand() string {
 	fmt.Fprintf(w, "\n SERIAL\tCOMMAND\tOPTION\tARGS\tDESCRIPTION")                                 // Header
 	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "------", "-------", "------", "----", "-----------") // row separator
 	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "1", "/info", "", "", "display username & current room")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "2", "/room", "change", "[name]", "join to [name] room")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "3", "/client", "ignore", "[name]", "ignore [name] client's messages") //
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "4", "/client", "allow", "[name]", "allow [name] client's messages")   //
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "2", "/register", "", "", "protect your name with a password")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "3", "/room", "change", "[name] [pass]", "leave current room & join [name]")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "4", "/room", "join", "[name] [pass]", "also join [name] room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "5", "/room", "leave", "[name]", "leave [name] or current room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "6", "/room", "switch", "[name]", "send messages to [name] room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "7", "/room", "list", "", "list rooms with member count")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "8", "/room", "who", "", "list members of current room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "9", "/room", "topic", "[text]", "show or set current room topic")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "10", "/room", "invite", "[name]", "invite [name] to current room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "11", "/room", "mode", "[mode] [pass]", "public, invite or password room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "12", "/room", "kick", "[name]", "remove [name] from current room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "13", "/room", "ban", "[name] [dur]", "ban [name], forever without [dur]")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "14", "/room", "unban", "[name]", "lift the ban of [name]")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "15", "/room", "op|deop", "[name]", "grant or revoke room operator")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "16", "/room", "mute|unmute", "[name]", "silence or allow [name] in room")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "17", "/client", "ignore", "[name]", "ignore [name] client's messages") //
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "18", "/client", "allow", "[name]", "allow [name] client's messages")   //
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "19", "/msg", "", "[name] [text]", "send [text] privately to [name]")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "20", "/notify", "on|off", "", "show or hide join & leave notices")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "21", "/set", "color", "on|off", "colored or plain text output")
 	err := w.Flush()
 	if err != nil {
 		panic(err)
@@ -68,9 +134,26 @@ func disHelpCommand() string {
 	wr.WriteString("\n\r")
 	wr.WriteString("\nExamples\n\r")
 	fmt.Fprintf(w, "\n %s\t%s\t", "1", "/info")
-	fmt.Fprintf(w, "\n %s\t%s\t", "2", "/room change myroom3")
-	fmt.Fprintf(w, "\n %s\t%s\t", "3", "/client ignore annoyignone")
-	fmt.Fprintf(w, "\n %s\t%s\t", "4", "/client allow annoyignore")
+	fmt.Fprintf(w, "\n %s\t%s\t", "2", "/register")
+	fmt.Fprintf(w, "\n %s\t%s\t", "3", "/room change myroom3")
+	fmt.Fprintf(w, "\n %s\t%s\t", "4", "/room join myroom4")
+	fmt.Fprintf(w, "\n %s\t%s\t", "5", "/room leave myroom3")
+	fmt.Fprintf(w, "\n %s\t%s\t", "6", "/room switch myroom4")
+	fmt.Fprintf(w, "\n %s\t%s\t", "7", "/room list")
+	fmt.Fprintf(w, "\n %s\t%s\t", "8", "/room who")
+	fmt.Fprintf(w, "\n %s\t%s\t", "9", "/room topic release on friday")
+	fmt.Fprintf(w, "\n %s\t%s\t", "10", "/room invite annoyignore")
+	fmt.Fprintf(w, "\n %s\t%s\t", "11", "/room mode password s3cret")
+	fmt.Fprintf(w, "\n %s\t%s\t", "12", "/room kick annoyignore")
+	fmt.Fprintf(w, "\n %s\t%s\t", "13", "/room ban annoyignore 1h")
+	fmt.Fprintf(w, "\n %s\t%s\t", "14", "/room unban annoyignore")
+	fmt.Fprintf(w, "\n %s\t%s\t", "15", "/room op anand")
+	fmt.Fprintf(w, "\n %s\t%s\t", "16", "/room mute annoyignore")
+	fmt.Fprintf(w, "\n %s\t%s\t", "17", "/client ignore annoyignone")
+	fmt.Fprintf(w, "\n %s\t%s\t", "18", "/client allow annoyignore")
+	fmt.Fprintf(w, "\n %s\t%s\t", "19", "/msg annoyignore hi there")
+	fmt.Fprintf(w, "\n %s\t%s\t", "20", "/notify off")
+	fmt.Fprintf(w, "\n %s\t%s\t", "21", "/set color off")
 	err = w.Flush()
 	if err != nil {
 		panic(err)
@@ -102,6 +185,18 @@ func msgWriter(conn net.Conn, msg string) error {
 }
 
 func commandType(m string) optionType {
+	if m == directMsgPrefix || strings.HasPrefix(m, directMsgPrefix+" ") {
+		return directMsgOptionType
+	}
+
+	if m == notifyPrefix || strings.HasPrefix(m, notifyPrefix+" ") {
+		return notifyOptionType
+	}
+
+	if m == setPrefix || strings.HasPrefix(m, setPrefix+" ") {
+		return setOptionType
+	}
+
 	if strings.HasPrefix(m, clientPrefix) {
 		return clientOptionType
 	}
@@ -119,6 +214,11 @@ type telnetHandler struct {
 	chatStore *chatDataStore
 	helpDMsg  string
 	hook      func() // hook is a test noop in live code
+	// history source the messages replayed to the client on room join.
+	history     historyReader
+	historySize int
+	// users holds the registered accounts, that are password protected.
+	users *userStore
 }
 
 func newTelnetS(lw io.Writer) *telnetHandler {
@@ -127,21 +227,25 @@ func newTelnetS(lw io.Writer) *telnetHandler {
 		chatStore: newChatDataStore(lw),
 		helpDMsg:  disHelpCommand(),
 		hook:      func() {}, // noop function
+		users:     newUserStore(),
 	}
 }
 
-func newTelnetHFromChatStore(lw io.Writer, store *chatDataStore) *telnetHandler {
+func newTelnetHFromChatStore(lw io.Writer, store *chatDataStore, hr historyReader, historySize int, users *userStore) *telnetHandler {
 	return &telnetHandler{
-		mWriter:   lw,
-		chatStore: store,
-		helpDMsg:  disHelpCommand(),
-		hook:      func() {}, // noop function
+		mWriter:     lw,
+		chatStore:   store,
+		helpDMsg:    disHelpCommand(),
+		hook:        func() {}, // noop function
+		history:     hr,
+		historySize: historySize,
+		users:       users,
 	}
 }
 
 // cmdErrWriter writes error in formatted form when any wrong command is provided.
 func (ts *telnetHandler) cmdErrWriter(conn net.Conn, cmd string) error {
-	err := msgWriter(conn, formatCMDErr(cmd))
+	err := msgWriter(conn, render(conn).errMsg("invalid command", cmd))
 	if err != nil {
 		return err
 	}
@@ -150,7 +254,7 @@ func (ts *telnetHandler) cmdErrWriter(conn net.Conn, cmd string) error {
 
 // infoPrompt writes the information back to user when requested
 func (ts *telnetHandler) infoPrompt(conn net.Conn, name, room string) error {
-	return msgWriter(conn, infoDisplay(name, room))
+	return msgWriter(conn, render(conn).info(name, room))
 }
 
 func (ts *telnetHandler) displayHelp(conn net.Conn, name, room string) error {
@@ -161,30 +265,243 @@ func (ts *telnetHandler) displayHelp(conn net.Conn, name, room string) error {
 	return ts.infoPrompt(conn, name, room)
 }
 
-// roomCommandOps handles all room command operation
-func (ts *telnetHandler) roomCommandOps(conn net.Conn, cmd, name string, roomName *string) error {
+// replayHistory delivers the last historySize messages of the room to the client session.
+func (ts *telnetHandler) replayHistory(sess session, room string) error {
+	if ts.history == nil || ts.historySize <= 0 {
+		return nil
+	}
+	msgs, err := ts.history.lastMessages(roomID(room), ts.historySize)
+	if err != nil {
+		// history is best effort, don't drop the client.
+		log.Printf("unable to read room history, err: %v\n", err)
+		return nil
+	}
+	for _, m := range msgs {
+		err := sess.deliver(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roomCommandOps handles all room command operation, roomName is the active room
+// of the client where the typed messages are sent.
+func (ts *telnetHandler) roomCommandOps(conn net.Conn, sess session, cmd, name string, roomName *string) error {
 	cmds := strings.Split(cmd, " ")
-	if len(cmds) != 3 {
+	if len(cmds) >= 2 && strings.TrimSpace(cmds[1]) == "topic" {
+		return ts.topicOps(conn, sess, cmd, name, *roomName)
+	}
+	if len(cmds) == 2 {
+		switch strings.TrimSpace(cmds[1]) {
+		case "list": // list
+			return msgWriter(conn, render(conn).roomList(ts.chatStore.listRooms()))
+		case "who": // who
+			members, _ := ts.chatStore.roomMembers(*roomName)
+			return msgWriter(conn, render(conn).roomMembers(*roomName, members))
+		case "leave": // leave the active room
+			return ts.leaveRoom(conn, cmd, name, *roomName, roomName)
+		}
+	}
+	if len(cmds) != 3 && len(cmds) != 4 {
 		return ts.cmdErrWriter(conn, cmd)
 	}
 	option := strings.TrimSpace(cmds[1])
 	arg := strings.TrimSpace(cmds[2])
+	if len(arg) == 0 {
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	// extra is the room password of the change, join and mode options,
+	// or the duration of the ban option.
+	var extra string
+	if len(cmds) == 4 {
+		extra = strings.TrimSpace(cmds[3])
+		if option != "change" && option != "join" && option != "mode" && option != "ban" {
+			return ts.cmdErrWriter(conn, cmd)
+		}
+	}
 	switch option {
 	case "change": // change
-		if len(arg) == 0 {
-			return ts.cmdErrWriter(conn, cmd)
+		err := ts.chatStore.joinRoom(name, arg, extra)
+		if err != nil {
+			return ts.reasonErrWriter(conn, err, arg)
+		}
+		// remove from previous room
+		if *roomName != arg {
+			ts.chatStore.removeClientFromRoom(name, *roomName)
+		}
+		return ts.enteredRoom(conn, sess, name, arg, roomName)
+	case "join": // join
+		err := ts.chatStore.joinRoom(name, arg, extra)
+		if err != nil {
+			return ts.reasonErrWriter(conn, err, arg)
+		}
+		return ts.enteredRoom(conn, sess, name, arg, roomName)
+	case "leave": // leave
+		return ts.leaveRoom(conn, cmd, name, arg, roomName)
+	case "switch": // switch
+		if !ts.chatStore.isRoomMember(name, arg) {
+			return ts.reasonErrWriter(conn, errNotRoomMember, arg)
 		}
-		// remove from current room
-		ts.chatStore.removeClientFromRoom(name, *roomName)
-		// add the client to the new room
-		ts.chatStore.addClientToRoom(name, arg)
 		*roomName = arg
 		return ts.infoPrompt(conn, name, *roomName)
+	case "invite": // invite
+		err := ts.chatStore.inviteToRoom(name, *roomName, arg)
+		if err != nil {
+			return ts.reasonErrWriter(conn, err, *roomName)
+		}
+		return sess.deliver(newSystemMessage(*roomName, fmt.Sprintf("invited %s", arg)))
+	case "mode": // mode
+		mode, err := parseRoomMode(arg)
+		if err != nil {
+			return ts.cmdErrWriter(conn, cmd)
+		}
+		err = ts.chatStore.setRoomMode(name, *roomName, mode, extra)
+		if err != nil {
+			return ts.reasonErrWriter(conn, err, *roomName)
+		}
+		return sess.deliver(newSystemMessage(*roomName, fmt.Sprintf("mode set to %s", mode)))
+	case "kick", "ban", "unban", "op", "deop", "mute", "unmute":
+		return ts.moderateOps(conn, cmd, option, name, *roomName, arg, extra)
 	default:
 		return ts.cmdErrWriter(conn, cmd)
 	}
 }
 
+// checkSend writes the reason the client messages can't be sent to the room, if any.
+// The client could have been kicked, banned or muted from its active room.
+func (ts *telnetHandler) checkSend(conn net.Conn, name, room string) error {
+	if !ts.chatStore.isRoomMember(name, room) {
+		return ts.reasonErrWriter(conn, errNotRoomMember, room)
+	}
+	err := ts.chatStore.checkSend(name, room)
+	if err != nil {
+		return ts.reasonErrWriter(conn, err, room)
+	}
+	return nil
+}
+
+// moderateOps handles the room moderation options of the active room on the target client.
+func (ts *telnetHandler) moderateOps(conn net.Conn, cmd, option, name, room, target, duration string) error {
+	var err error
+	switch option {
+	case "kick":
+		err = ts.chatStore.kickFromRoom(name, room, target)
+	case "ban":
+		var d time.Duration
+		if duration != "" {
+			d, err = time.ParseDuration(duration)
+			if err != nil || d < 0 {
+				return ts.cmdErrWriter(conn, cmd)
+			}
+		}
+		err = ts.chatStore.banFromRoom(name, room, target, d)
+	case "unban":
+		err = ts.chatStore.unbanFromRoom(name, room, target)
+	case "op", "deop":
+		err = ts.chatStore.setRoomOperator(name, room, target, option == "op")
+	case "mute", "unmute":
+		err = ts.chatStore.muteInRoom(name, room, target, option == "mute")
+	}
+	if err != nil {
+		return ts.reasonErrWriter(conn, err, room)
+	}
+	ts.hook()
+	return nil
+}
+
+// reasonErrWriter writes the reason the command was rejected along with its subject,
+// rather than the command itself so that the secrets are never echoed back.
+func (ts *telnetHandler) reasonErrWriter(conn net.Conn, reason error, subject string) error {
+	err := msgWriter(conn, render(conn).errMsg(reason.Error(), subject))
+	if err != nil {
+		return err
+	}
+	return errInvalidCommand
+}
+
+// enteredRoom makes the room the client has joined the active room, and shows
+// the room topic and history.
+func (ts *telnetHandler) enteredRoom(conn net.Conn, sess session, name, room string, roomName *string) error {
+	*roomName = room
+	err := ts.infoPrompt(conn, name, *roomName)
+	if err != nil {
+		return err
+	}
+	err = ts.showTopic(sess, *roomName)
+	if err != nil {
+		return err
+	}
+	return ts.replayHistory(sess, *roomName)
+}
+
+// showTopic delivers the topic of the room to the client session, if the room has one.
+func (ts *telnetHandler) showTopic(sess session, room string) error {
+	r, ok := ts.chatStore.roomMetadata(room)
+	if !ok || r.Topic == "" {
+		return nil
+	}
+	return sess.deliver(newSystemMessage(room, "topic: "+r.Topic))
+}
+
+// topicOps shows the topic of the active room, or changes it when a text is given.
+func (ts *telnetHandler) topicOps(conn net.Conn, sess session, cmd, name, room string) error {
+	cmds := strings.SplitN(cmd, " ", 3)
+	if len(cmds) == 2 {
+		r, _ := ts.chatStore.roomMetadata(room)
+		if r.Topic == "" {
+			return sess.deliver(newSystemMessage(room, "no topic set"))
+		}
+		return sess.deliver(newSystemMessage(room, "topic: "+r.Topic))
+	}
+	topic := strings.TrimSpace(cmds[2])
+	if len(topic) == 0 {
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	_, err := ts.chatStore.updateRoomMeta(room, name, &topic, nil)
+	if errors.Is(err, errUnknownRoom) {
+		return ts.reasonErrWriter(conn, err, room)
+	}
+	if err != nil {
+		// the topic is changed, only persisting it failed.
+		log.Printf("unable to save the rooms metadata, err: %v\n", err)
+	}
+	return nil
+}
+
+// leaveRoom removes the client from the room, if it was the active room
+// another room of the client becomes the active one.
+// The client cannot leave its last room.
+func (ts *telnetHandler) leaveRoom(conn net.Conn, cmd, name, room string, roomName *string) error {
+	rooms := ts.chatStore.clientRooms(name)
+	var other string
+	member := false
+	for _, r := range rooms {
+		if string(r) == room {
+			member = true
+			continue
+		}
+		if other == "" {
+			other = string(r)
+		}
+	}
+	if !member {
+		return ts.reasonErrWriter(conn, errNotRoomMember, room)
+	}
+	if other == "" {
+		err := msgWriter(conn, render(conn).errMsg("cannot leave the last room", cmd))
+		if err != nil {
+			return err
+		}
+		return errInvalidCommand
+	}
+	ts.chatStore.removeClientFromRoom(name, room)
+	if *roomName == room {
+		*roomName = other
+	}
+	return ts.infoPrompt(conn, name, *roomName)
+}
+
 func (ts *telnetHandler) clientCommandOps(conn net.Conn, name, cmd string) error {
 	cmds := strings.Split(cmd, " ")
 	if len(cmds) != 3 {
@@ -213,64 +530,263 @@ func (ts *telnetHandler) clientCommandOps(conn net.Conn, name, cmd string) error
 	return nil
 }
 
-// serveConn serve all of the net.Conn
-func (ts *telnetHandler) serveConn(conn net.Conn) {
-	defer func() {
-		err := conn.Close()
+// readSecret prompts for a secret, like a password, with the client echo turned off and reads it.
+func (ts *telnetHandler) readSecret(conn net.Conn, connScan *bufio.Scanner, prompt string) (string, error) {
+	echoOff, err := echoCommand(conn, false)
+	if err != nil {
+		return "", err
+	}
+	err = msgWriter(conn, echoOff+prompt)
+	if err != nil {
+		return "", err
+	}
+	if !connScan.Scan() {
+		err := connScan.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		return "", err
+	}
+	secret := strings.TrimSpace(connScan.Text())
+	echoOn, err := echoCommand(conn, true)
+	if err != nil {
+		return "", err
+	}
+	// the client has not echoed the new line either.
+	err = msgWriter(conn, echoOn+"\n\r")
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// registerOps registers the client name as an account protected by the password
+// prompted for twice.
+func (ts *telnetHandler) registerOps(conn net.Conn, sess session, connScan *bufio.Scanner, name, room string) error {
+	if ts.users.isRegistered(name) {
+		return ts.reasonErrWriter(conn, errAlreadyRegistered, name)
+	}
+	password, err := ts.readSecret(conn, connScan, "Password: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := ts.readSecret(conn, connScan, "Confirm Password: ")
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return ts.reasonErrWriter(conn, errors.New("passwords do not match"), registerCommand)
+	}
+	err = ts.users.register(name, password)
+	if err != nil {
+		if !errors.Is(err, errAlreadyRegistered) && !errors.Is(err, errEmptyPassword) {
+			log.Printf("unable to register the account, err: %v\n", err)
+			err = errors.New("unable to register")
+		}
+		return ts.reasonErrWriter(conn, err, name)
+	}
+	return sess.deliver(newSystemMessage(room, fmt.Sprintf("%s is now registered, the name is password protected", name)))
+}
+
+// notifyCommandOps turns on or off the join and leave notices of the client.
+func (ts *telnetHandler) notifyCommandOps(conn net.Conn, name, cmd string) error {
+	cmds := strings.Split(cmd, " ")
+	if len(cmds) != 2 {
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	switch strings.TrimSpace(cmds[1]) {
+	case "on":
+		ts.chatStore.setNotify(name, true)
+	case "off":
+		ts.chatStore.setNotify(name, false)
+	default:
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	ts.hook()
+	return nil
+}
+
+// setCommandOps handles the client settings command, the colour of the output.
+func (ts *telnetHandler) setCommandOps(conn net.Conn, cmd string) error {
+	cmds := strings.Fields(cmd)
+	rh, ok := conn.(rendererHolder)
+	if len(cmds) != 3 || cmds[1] != "color" || !ok {
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	switch cmds[2] {
+	case "on":
+		rh.setRenderer(ansiRenderer{})
+	case "off":
+		rh.setRenderer(plainRenderer{})
+	default:
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	ts.hook()
+	return msgWriter(conn, rh.renderer().system(metaRoom, "color "+cmds[2]))
+}
+
+// directMsgOps handles the private message command.
+func (ts *telnetHandler) directMsgOps(conn net.Conn, name, cmd string, origin messageOrigin) error {
+	cmds := strings.SplitN(cmd, " ", 3)
+	if len(cmds) != 3 {
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	to := strings.TrimSpace(cmds[1])
+	text := strings.TrimSpace(cmds[2])
+	if len(to) == 0 || len(text) == 0 {
+		return ts.cmdErrWriter(conn, cmd)
+	}
+	m := newDirectMessage(name, to, text, origin)
+	err := ts.chatStore.directMsg(context.TODO(), m)
+	if errors.Is(err, errUnknownClient) {
+		err = msgWriter(conn, render(conn).errMsg("unknown client", to))
 		if err != nil {
-			log.Println("conn close failed, err: ", err)
+			return err
 		}
-	}()
+		return errInvalidCommand
+	}
+	ts.logWriter(m)
+	return nil
+}
+
+// identifiedConn is implemented by the conns whose transport authenticated the client,
+// like ssh, they are not asked for a name.
+type identifiedConn interface {
+	// identity returns the authenticated chat name of the client.
+	identity() string
+}
+
+// login welcomes the client, and asks its name until one is available.
+// Registered names are asked for their password. It returns the name registered
+// with the chat store, false if the client left before.
+func (ts *telnetHandler) login(conn net.Conn, sess session, connScan *bufio.Scanner) (string, bool) {
 	// Welcome user on the screen.
+	openNegotiation(conn)
 	err := msgWriter(conn, welcomeMsg)
 	if err != nil {
 		log.Println("unable to welcome user on screen, err: ", err)
-		return
+		return "", false
 	}
-
-	// split read each line from conn
-	connScan := bufio.NewScanner(conn)
-	var name string
+	loginFailures := 0
 	// split scan on new line
 	// get user name
-
-	// clientReg marks that this client has been registered
-	// this prevent the case when the client terminate the connection
-	// before it get registered with the store,
-	clientReg := false
 	for connScan.Scan() {
 		if err := connScan.Err(); err != nil {
 			log.Println("username scan failed", err)
-			return
+			return "", false
 		}
-		name = connScan.Text()
+		name := strings.TrimSpace(connScan.Text())
 		if name == "" {
 			err = msgWriter(conn, "name cannot be empty \n>>")
 			if err != nil {
 				log.Println("conn write failed, err: ", err)
-				return
+				return "", false
 			}
 			continue
 		}
 
+		// registered names are password protected.
+		if ts.users.isRegistered(name) {
+			password, err := ts.readSecret(conn, connScan, "Password: ")
+			if err != nil {
+				return "", false
+			}
+			if ts.users.authenticate(name, password) != nil {
+				loginFailures++
+				if loginFailures >= maxLoginAttempts {
+					_ = msgWriter(conn, "too many failed login attempts \n")
+					return "", false
+				}
+				err = msgWriter(conn, "wrong password, try again \n>>")
+				if err != nil {
+					log.Println("conn write failed, err: ", err)
+					return "", false
+				}
+				continue
+			}
+		}
+
 		// if name is already taken ask for new name.
-		if err := ts.chatStore.registerClient(name, conn); err != nil {
+		if err := ts.chatStore.registerClient(name, sess); err != nil {
 			err = msgWriter(conn, fmt.Sprintf("name %s Taken, try new name \n>>", name))
 			if err != nil {
 				log.Println("conn write failed, err: ", err)
-				return
+				return "", false
 			}
 			continue
 		}
-		clientReg = true
-		break
+		return name, true
+	}
+	return "", false
+}
+
+// loginIdentified registers the client with the name authenticated by the conn.
+// The password of the registered names is not asked, the transport already authenticated the client.
+func (ts *telnetHandler) loginIdentified(conn net.Conn, sess session, name string) (string, bool) {
+	if err := ts.chatStore.registerClient(name, sess); err != nil {
+		err = msgWriter(conn, fmt.Sprintf("name %s Taken, already connected \n", name))
+		if err != nil {
+			log.Println("conn write failed, err: ", err)
+		}
+		return "", false
+	}
+	return name, true
+}
+
+// serveConn serve all of the telnet net.Conn
+func (ts *telnetHandler) serveConn(conn net.Conn) {
+	tc := newTelnetConn(conn)
+	ts.serveSession(tc, newTelnetSession(tc), originTelnet)
+}
+
+// serveSession serve the command loop over the conn, the chat messages
+// are delivered to the client through the sess. The messages sent by the client
+// are recorded with the origin of its transport.
+func (ts *telnetHandler) serveSession(conn net.Conn, sess session, origin messageOrigin) {
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			log.Println("conn close failed, err: ", err)
+		}
+	}()
+	// split read each line from conn
+	connScan := bufio.NewScanner(conn)
+	var name string
+	// clientReg marks that this client has been registered
+	// this prevent the case when the client terminate the connection
+	// before it get registered with the store,
+	var clientReg bool
+	if ic, ok := conn.(identifiedConn); ok {
+		name, clientReg = ts.loginIdentified(conn, sess, ic.identity())
+	} else {
+		name, clientReg = ts.login(conn, sess, connScan)
 	}
 	if !clientReg {
 		return
 	}
-	defer ts.chatStore.deleteClient(name)
+	defer func() {
+		// the name is free once the client leaves, anyone can take it unless registered.
+		if !ts.users.isRegistered(name) {
+			ts.chatStore.releaseRoomRoles(func(cid clientID) bool {
+				return cid == clientID(name)
+			})
+		}
+		ts.chatStore.deleteClient(name)
+	}()
 	currentRoom := metaRoom
-	err = ts.displayHelp(conn, name, currentRoom)
+	// the terminal type is told by the telnet client well before its name.
+	if tc, ok := conn.(*telnetConn); ok {
+		tc.setRenderer(rendererForTerm(tc.capabilities().TermType))
+	}
+	err := ts.displayHelp(conn, name, currentRoom)
+	if err != nil {
+		return
+	}
+	err = ts.showTopic(sess, currentRoom)
+	if err != nil {
+		return
+	}
+	err = ts.replayHistory(sess, currentRoom)
 	if err != nil {
 		return
 	}
@@ -284,6 +800,14 @@ func (ts *telnetHandler) serveConn(conn net.Conn) {
 			return
 		}
 		command := strings.TrimSpace(connScan.Text())
+		// the client may have been kicked or banned from the active room since its last command.
+		if room, moved := ts.chatStore.activeRoom(name, currentRoom); moved {
+			currentRoom = room
+			err := ts.infoPrompt(conn, name, currentRoom)
+			if err != nil {
+				return
+			}
+		}
 		switch command {
 		// single command
 		case helpCommand:
@@ -296,14 +820,27 @@ func (ts *telnetHandler) serveConn(conn net.Conn) {
 			if err != nil {
 				return
 			}
+		case registerCommand:
+			err := ts.registerOps(conn, sess, connScan, name, currentRoom)
+			if err != nil && !errors.Is(err, errInvalidCommand) {
+				return
+			}
 		default:
 			// check if command query
 			switch commandType(command) {
 			case msgOptionType:
-				ts.chatStore.broadcastMsg(context.TODO(), name, currentRoom, []byte(formatDM(name, currentRoom, command)))
-				ts.logWriter(command)
+				err := ts.checkSend(conn, name, currentRoom)
+				if err != nil {
+					if !errors.Is(err, errInvalidCommand) {
+						return
+					}
+					continue
+				}
+				m := newChatMessage(name, currentRoom, command, origin)
+				ts.chatStore.broadcastMsg(context.TODO(), m)
+				ts.logWriter(m)
 			case roomOptionType:
-				err := ts.roomCommandOps(conn, command, name, &currentRoom)
+				err := ts.roomCommandOps(conn, sess, command, name, &currentRoom)
 				if err != nil && !errors.Is(err, errInvalidCommand) {
 					return
 				}
@@ -312,13 +849,28 @@ func (ts *telnetHandler) serveConn(conn net.Conn) {
 				if err != nil && !errors.Is(err, errInvalidCommand) {
 					return
 				}
+			case directMsgOptionType:
+				err := ts.directMsgOps(conn, name, command, origin)
+				if err != nil && !errors.Is(err, errInvalidCommand) {
+					return
+				}
+			case notifyOptionType:
+				err := ts.notifyCommandOps(conn, name, command)
+				if err != nil && !errors.Is(err, errInvalidCommand) {
+					return
+				}
+			case setOptionType:
+				err := ts.setCommandOps(conn, command)
+				if err != nil && !errors.Is(err, errInvalidCommand) {
+					return
+				}
 			}
 		}
 	}
 }
 
-func (ts *telnetHandler) logWriter(command string) {
-	_, err := ts.mWriter.Write([]byte(command + "\n\r")) // write message to the log file
+func (ts *telnetHandler) logWriter(m chatMessage) {
+	err := writeMessage(ts.mWriter, m) // write message to the log file
 	if err != nil {
 		log.Println("error writing message to the log file")
 	}
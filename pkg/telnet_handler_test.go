@@ -3,13 +3,19 @@ package pkg
 import (
 	"bytes"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -22,6 +28,8 @@ func TestMain(m *testing.M) {
 	if !*printLog {
 		log.SetOutput(ioutil.Discard)
 	}
+	// keep the password hashing fast in tests.
+	passwordCost = bcrypt.MinCost
 	os.Exit(m.Run())
 }
 
@@ -155,6 +163,26 @@ func TestServeConnDrop(t *testing.T) {
 	must(t, err)
 }
 
+func TestIACRelayServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+	drainMsgs(t, cc1)
+
+	// the escaped IAC sent by a client is relayed escaped, not as a telnet command.
+	writeMsg(t, cc1, []byte("x\xff\xff\xfc\x01\n\r"))
+	readM := make([]byte, 4096)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("x\xff\xff\xfc\x01")) || bytes.Contains(readM, []byte("x\xff\xfc")) {
+		t.Errorf("expected the IAC escaped got %q", readM)
+	}
+}
+
 func TestIgnoreAllowClientServeConn(t *testing.T) {
 	t.Parallel()
 	ts := newTelnetS(ioutil.Discard)
@@ -175,6 +203,7 @@ func TestIgnoreAllowClientServeConn(t *testing.T) {
 	sc3, cc3 := net.Pipe()
 	go ts.serveConn(sc3)
 	initialRead(t, cc3, []byte("ankuranand\n\r"))
+	drainMsgs(t, cc1, cc2)
 
 	// ankuranand to ignore msg from ankur
 	msg := []byte("/client ignore ankur\n\r")
@@ -242,6 +271,7 @@ func TestRoomChangeServeConn(t *testing.T) {
 	sc3, cc3 := net.Pipe()
 	go ts.serveConn(sc3)
 	initialRead(t, cc3, []byte("ankuranand\n\r"))
+	drainMsgs(t, cc1, cc2)
 
 	// all three room change
 	for _, cl := range []net.Conn{cc1, cc2, cc3} {
@@ -252,6 +282,7 @@ func TestRoomChangeServeConn(t *testing.T) {
 		err := readMsg(t, cl, readM)
 		must(t, err)
 	}
+	drainMsgs(t, cc1, cc2, cc3)
 
 	// ankur client send msg
 	msg := []byte("hello everyone\n\r")
@@ -282,6 +313,7 @@ func TestRoomChangeServeConn(t *testing.T) {
 		err := readMsg(t, cl, readM)
 		must(t, err)
 	}
+	drainMsgs(t, cc2, cc3)
 
 	// ankur client send msg
 	msg = []byte("hello everyone\n\r")
@@ -318,6 +350,10 @@ func TestRoomChangeServeConn(t *testing.T) {
 	}
 }
 
+// xtermType tells the terminal type of the client, XTERM, as asked by the server.
+const xtermType = "\xff\xfb\x18\xff\xfa\x18\x00XTERM\xff\xf0"
+
+// initialRead logs in the client with the name, from an xterm terminal.
 func initialRead(t *testing.T, cc net.Conn, name []byte) {
 	t.Helper()
 	defer func() {
@@ -329,8 +365,11 @@ func initialRead(t *testing.T, cc net.Conn, name []byte) {
 	b := make([]byte, 4096)
 	_, err = cc.Read(b)
 	must(t, err)
-	// send the name
-	_, err = cc.Write(name)
+	// send the terminal type and the name
+	_, err = cc.Write(append([]byte(xtermType), name...))
+	must(t, err)
+	// read the terminal type request
+	_, err = cc.Read(b)
 	must(t, err)
 	b = make([]byte, 4096)
 	// read the help response helpDMsg
@@ -366,9 +405,684 @@ func readMsg(t *testing.T, cc net.Conn, msg []byte) error {
 	return err
 }
 
+// drainMsgs reads and discards everything written to the conns until nothing
+// more arrives, such as the join and leave notices of other clients.
+func drainMsgs(t *testing.T, conns ...net.Conn) {
+	t.Helper()
+	for _, cc := range conns {
+		for {
+			err := cc.SetDeadline(time.Now().Add(time.Millisecond * 50))
+			must(t, err)
+			b := make([]byte, 4096)
+			if _, err := cc.Read(b); err != nil {
+				break
+			}
+		}
+		err := cc.SetDeadline(time.Time{})
+		must(t, err)
+	}
+}
+
 func must(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+// staticHistory is a historyReader over a fixed set of messages.
+type staticHistory []chatMessage
+
+func (sh staticHistory) lastMessages(room roomID, n int) ([]chatMessage, error) {
+	var msgs []chatMessage
+	for _, m := range sh {
+		if m.Room == room {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return msgs, nil
+}
+
+func TestRoomHistoryReplayServeConn(t *testing.T) {
+	t.Parallel()
+	hist := staticHistory{
+		newChatMessage("anand", "roomname", "old message 1", originTelnet),
+		newChatMessage("anand", "other", "other room message", originTelnet),
+		newChatMessage("anand", "roomname", "old message 2", originREST),
+		newChatMessage("anand", "roomname", "old message 3", originTelnet),
+	}
+	ts := newTelnetHFromChatStore(ioutil.Discard, newChatDataStore(ioutil.Discard), hist, 2, newUserStore())
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	writeMsg(t, cc1, []byte("/room change roomname\n\r"))
+	// read the room response
+	readM := make([]byte, 512)
+	err := readMsg(t, cc1, readM)
+	must(t, err)
+	// read the replayed history, one message at a time.
+	for _, expected := range []string{"old message 2", "old message 3"} {
+		readM = make([]byte, 512)
+		err = readMsg(t, cc1, readM)
+		must(t, err)
+		if !bytes.Contains(readM, []byte(expected)) {
+			t.Errorf("expected msg: %s not found in replayed history", expected)
+		}
+	}
+	readM = make([]byte, 512)
+	err = readMsg(t, cc1, readM)
+	if err == nil {
+		t.Errorf("unexpected msg: %s found in replayed history", readM)
+	}
+}
+
+func TestDirectMsgServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	done := make(chan bool)
+	ts.hook = func() {
+		done <- true
+	}
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+
+	sc3, cc3 := net.Pipe()
+	go ts.serveConn(sc3)
+	initialRead(t, cc3, []byte("ankuranand\n\r"))
+	drainMsgs(t, cc1, cc2)
+
+	writeMsg(t, cc1, []byte("/msg anand hello only you\n\r"))
+	readM := make([]byte, 512)
+	err := readMsg(t, cc2, readM)
+	must(t, err)
+	if !bytes.Contains(readM, []byte("hello only you")) || !bytes.Contains(readM, []byte("(private)")) {
+		t.Errorf("expected private msg: %s not found in received msg", "hello only you")
+	}
+	for _, cl := range []net.Conn{cc1, cc3} {
+		readM := make([]byte, 512)
+		err := readMsg(t, cl, readM)
+		if err == nil {
+			t.Error("expected read deadline error got nil")
+		}
+	}
+
+	// unknown recipient.
+	writeMsg(t, cc1, []byte("/msg nobody hello\n\r"))
+	readM = make([]byte, 512)
+	err = readMsg(t, cc1, readM)
+	must(t, err)
+	if !bytes.Contains(readM, []byte("unknown client")) {
+		t.Errorf("expected unknown client err got %s", readM)
+	}
+
+	// ignored sender.
+	writeMsg(t, cc2, []byte("/client ignore ankur\n\r"))
+	select {
+	case <-time.After(time.Second * 2):
+		t.Error("timeout waiting for hook call back")
+	case <-done:
+	}
+	writeMsg(t, cc1, []byte("/msg anand hello again\n\r"))
+	readM = make([]byte, 512)
+	err = readMsg(t, cc2, readM)
+	if err == nil {
+		t.Error("expected read deadline error got nil")
+	}
+}
+
+func TestRoomListAndWhoServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+
+	writeMsg(t, cc2, []byte("/room change roomname\n\r"))
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	drainMsgs(t, cc1, cc2)
+
+	writeMsg(t, cc1, []byte("/room list\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	expected := formatRoomList([]roomInfo{{Name: "default", Members: 1}, {Name: "roomname", Members: 1}})
+	if !bytes.HasPrefix(readM, []byte(expected)) {
+		t.Errorf("expected room list %q got %q", expected, readM)
+	}
+
+	writeMsg(t, cc2, []byte("/room who\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	expected = formatRoomMembers("roomname", []clientID{"anand"})
+	if !bytes.HasPrefix(readM, []byte(expected)) {
+		t.Errorf("expected room members %q got %q", expected, readM)
+	}
+}
+
+func TestPresenceNotifyServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	done := make(chan bool)
+	ts.hook = func() {
+		done <- true
+	}
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("anand joined #default")) {
+		t.Errorf("expected join notice got %q", readM)
+	}
+
+	writeMsg(t, cc2, []byte("/room change roomname\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("anand left #default")) {
+		t.Errorf("expected leave notice got %q", readM)
+	}
+	drainMsgs(t, cc2)
+
+	// invalid toggle.
+	writeMsg(t, cc1, []byte("/notify maybe\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("invalid command")) {
+		t.Errorf("expected invalid command err got %q", readM)
+	}
+
+	writeMsg(t, cc1, []byte("/notify off\n\r"))
+	select {
+	case <-time.After(time.Second * 2):
+		t.Error("timeout waiting for hook call back")
+	case <-done:
+	}
+	writeMsg(t, cc2, []byte("/room change default\n\r"))
+	readM = make([]byte, 512)
+	if err := readMsg(t, cc1, readM); err == nil {
+		t.Errorf("expected no notice after /notify off got %q", readM)
+	}
+}
+
+func TestServeConnChurn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				sc, cc := net.Pipe()
+				go ts.serveConn(sc)
+				// keep reading whatever the other clients send until closed.
+				readDone := make(chan struct{})
+				go func() {
+					defer close(readDone)
+					_, _ = io.Copy(ioutil.Discard, cc)
+				}()
+				_, err := cc.Write([]byte(fmt.Sprintf("churn%d-%d\n\r", i, j)))
+				must(t, err)
+				_, err = cc.Write([]byte(fmt.Sprintf("/room change room%d\n\r", j)))
+				must(t, err)
+				_, err = cc.Write([]byte("hello everyone\n\r"))
+				must(t, err)
+				must(t, cc.Close())
+				<-readDone
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if rooms := ts.chatStore.listRooms(); len(rooms) == 1 && rooms[0].Members == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Errorf("expected only the empty meta room left got %v", ts.chatStore.listRooms())
+}
+
+func TestMultiRoomServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+
+	writeMsg(t, cc2, []byte("/room join roomname\n\r"))
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.HasPrefix(readM, []byte(infoDisplay("anand", "roomname"))) {
+		t.Errorf("expected info prompt got %q", readM)
+	}
+	writeMsg(t, cc1, []byte("/room join roomname\n\r"))
+	drainMsgs(t, cc1, cc2)
+
+	// anand receives the messages of both the rooms, labelled by room.
+	writeMsg(t, cc1, []byte("hello roomname\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("roomname\u001b[0m \u001B[33m:\u001B[0m  hello roomname")) {
+		t.Errorf("expected msg labelled with roomname got %q", readM)
+	}
+	writeMsg(t, cc1, []byte("/room switch default\n\r"))
+	must(t, readMsg(t, cc1, make([]byte, 512)))
+	writeMsg(t, cc1, []byte("hello default\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("default\u001b[0m \u001B[33m:\u001B[0m  hello default")) {
+		t.Errorf("expected msg labelled with default got %q", readM)
+	}
+
+	// switch only to the joined rooms.
+	writeMsg(t, cc2, []byte("/room switch nowhere\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("not a member of room")) {
+		t.Errorf("expected not a member err got %q", readM)
+	}
+
+	// leaving the active room makes the other room active.
+	writeMsg(t, cc2, []byte("/room leave\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.HasPrefix(readM, []byte(infoDisplay("anand", "default"))) {
+		t.Errorf("expected info prompt got %q", readM)
+	}
+	drainMsgs(t, cc1)
+	if rooms := ts.chatStore.clientRooms("anand"); len(rooms) != 1 || rooms[0] != metaRoom {
+		t.Errorf("expected anand only in default room got %v", rooms)
+	}
+
+	writeMsg(t, cc2, []byte("/room leave default\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("cannot leave the last room")) {
+		t.Errorf("expected last room err got %q", readM)
+	}
+}
+
+func TestRoomTopicServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	writeMsg(t, cc1, []byte("/room topic\n\r"))
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("no topic set")) {
+		t.Errorf("expected no topic got %q", readM)
+	}
+
+	writeMsg(t, cc1, []byte("/room topic release on friday\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("ankur changed the topic to: release on friday")) {
+		t.Errorf("expected topic notice got %q", readM)
+	}
+
+	// the topic is shown on join.
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("topic: release on friday")) {
+		t.Errorf("expected topic on join got %q", readM)
+	}
+}
+
+func TestRoomAccessServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+	drainMsgs(t, cc1)
+
+	writeMsg(t, cc1, []byte("/room change secret\n\r"))
+	drainMsgs(t, cc1, cc2)
+	writeMsg(t, cc1, []byte("/room mode password s3cret\n\r"))
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("mode set to password")) {
+		t.Errorf("expected mode notice got %q", readM)
+	}
+
+	writeMsg(t, cc2, []byte("/room change secret guess\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("wrong room password")) || bytes.Contains(readM, []byte("guess")) {
+		t.Errorf("expected wrong room password err got %q", readM)
+	}
+	writeMsg(t, cc2, []byte("/room change secret s3cret\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.HasPrefix(readM, []byte(infoDisplay("anand", "secret"))) {
+		t.Errorf("expected info prompt got %q", readM)
+	}
+	drainMsgs(t, cc1)
+
+	// only the owner can change the mode.
+	writeMsg(t, cc2, []byte("/room mode public\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("not the room owner")) {
+		t.Errorf("expected not room owner err got %q", readM)
+	}
+
+	writeMsg(t, cc1, []byte("/room mode invite\n\r"))
+	must(t, readMsg(t, cc1, make([]byte, 512)))
+	sc3, cc3 := net.Pipe()
+	go ts.serveConn(sc3)
+	initialRead(t, cc3, []byte("ankuranand\n\r"))
+	writeMsg(t, cc3, []byte("/room join secret\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc3, readM))
+	if !bytes.Contains(readM, []byte("room is invite only")) {
+		t.Errorf("expected invite only err got %q", readM)
+	}
+
+	writeMsg(t, cc1, []byte("/room invite ankuranand\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc3, readM))
+	if !bytes.Contains(readM, []byte("ankur invited you to #secret")) {
+		t.Errorf("expected invite notice got %q", readM)
+	}
+	drainMsgs(t, cc1)
+	writeMsg(t, cc3, []byte("/room join secret\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc3, readM))
+	if !bytes.HasPrefix(readM, []byte(infoDisplay("ankuranand", "secret"))) {
+		t.Errorf("expected info prompt got %q", readM)
+	}
+}
+
+func TestRoomRolesReleasedServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+	writeMsg(t, cc1, []byte("/room change secret\n\r"))
+	drainMsgs(t, cc1)
+	writeMsg(t, cc1, []byte("/room mode invite\n\r"))
+	drainMsgs(t, cc1)
+	must(t, cc1.Close())
+	deadline := time.Now().Add(time.Second)
+	for len(ts.chatStore.clientRooms("ankur")) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the next client taking the name not registered doesn't own the room.
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("ankur\n\r"))
+	writeMsg(t, cc2, []byte("/room join secret\n\r"))
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("room is invite only")) {
+		t.Errorf("expected invite only err got %q", readM)
+	}
+	if r, ok := ts.chatStore.roomMetadata("secret"); !ok || r.Creator != "" {
+		t.Errorf("expected the room owner to be released got %+v", r)
+	}
+}
+
+func TestRoomModerationServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	done := make(chan bool)
+	ts.hook = func() {
+		done <- true
+	}
+	waitHook := func() {
+		t.Helper()
+		select {
+		case <-time.After(time.Second * 2):
+			t.Error("timeout waiting for hook call back")
+		case <-done:
+		}
+	}
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+	writeMsg(t, cc1, []byte("/room change ops\n\r"))
+	drainMsgs(t, cc1, cc2)
+	writeMsg(t, cc2, []byte("/room change ops\n\r"))
+	drainMsgs(t, cc1, cc2)
+
+	writeMsg(t, cc2, []byte("/room kick ankur\n\r"))
+	readM := make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("not a room operator")) {
+		t.Errorf("expected not room operator err got %q", readM)
+	}
+
+	// the kicked client is moved to the meta room, its messages are posted there.
+	writeMsg(t, cc1, []byte("/room kick anand\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("you were kicked from #ops by ankur")) {
+		t.Errorf("expected kick notice got %q", readM)
+	}
+	waitHook()
+	drainMsgs(t, cc1, cc2)
+	writeMsg(t, cc2, []byte("hello ops\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.HasPrefix(readM, []byte(infoDisplay("anand", "default"))) {
+		t.Errorf("expected meta room info prompt got %q", readM)
+	}
+	if ts.chatStore.isRoomMember("anand", "ops") {
+		t.Errorf("expected kicked client not to be member of ops")
+	}
+
+	writeMsg(t, cc1, []byte("/room ban anand forever\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc1, readM))
+	if !bytes.Contains(readM, []byte("invalid command")) {
+		t.Errorf("expected invalid command err got %q", readM)
+	}
+	writeMsg(t, cc1, []byte("/room ban anand 1h\n\r"))
+	waitHook()
+	drainMsgs(t, cc1)
+	writeMsg(t, cc2, []byte("/room join ops\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("banned from room")) {
+		t.Errorf("expected banned from room err got %q", readM)
+	}
+
+	writeMsg(t, cc1, []byte("/room unban anand\n\r"))
+	waitHook()
+	writeMsg(t, cc2, []byte("/room join ops\n\r"))
+	drainMsgs(t, cc1, cc2)
+	writeMsg(t, cc1, []byte("/room mute anand\n\r"))
+	waitHook()
+	drainMsgs(t, cc1, cc2)
+	writeMsg(t, cc2, []byte("hello ops\n\r"))
+	readM = make([]byte, 512)
+	must(t, readMsg(t, cc2, readM))
+	if !bytes.Contains(readM, []byte("muted in room")) {
+		t.Errorf("expected muted in room err got %q", readM)
+	}
+	if err := readMsg(t, cc1, make([]byte, 512)); err == nil {
+		t.Error("expected read deadline error got nil")
+	}
+}
+
+// readPrompt reads a single write of the server and checks that it contains the text.
+func readPrompt(t *testing.T, cc net.Conn, text string) {
+	t.Helper()
+	readM := make([]byte, 4096)
+	must(t, readMsg(t, cc, readM))
+	if !bytes.Contains(readM, []byte(text)) {
+		t.Errorf("expected %q got %q", text, readM)
+	}
+}
+
+func TestRegisterAndLoginServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	initialRead(t, cc1, []byte("ankur\n\r"))
+
+	writeMsg(t, cc1, []byte("/register\n\r"))
+	readPrompt(t, cc1, "\xff\xfb\x01Password: ")
+	writeMsg(t, cc1, []byte("s3cret\n\r"))
+	readPrompt(t, cc1, "\xff\xfc\x01\n\r")
+	readPrompt(t, cc1, "Confirm Password: ")
+	// the answers of the client to the negotiation are not part of the password.
+	writeMsg(t, cc1, []byte("\xff\xfb\x1fs3cret\n\r"))
+	readPrompt(t, cc1, "\xff\xfc\x01\n\r")
+	readPrompt(t, cc1, "ankur is now registered")
+
+	writeMsg(t, cc1, []byte("/register\n\r"))
+	readPrompt(t, cc1, "name already registered")
+	must(t, cc1.Close())
+	deadline := time.Now().Add(time.Second)
+	for len(ts.chatStore.clientRooms("ankur")) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	readPrompt(t, cc2, welcomeMsg)
+	writeMsg(t, cc2, []byte("ankur\n\r"))
+	readPrompt(t, cc2, "Password: ")
+	writeMsg(t, cc2, []byte("guess\n\r"))
+	readPrompt(t, cc2, "\xff\xfc\x01\n\r")
+	readPrompt(t, cc2, "wrong password, try again")
+	writeMsg(t, cc2, []byte("ankur\n\r"))
+	readPrompt(t, cc2, "Password: ")
+	writeMsg(t, cc2, []byte("s3cret\n\r"))
+	readPrompt(t, cc2, "\xff\xfc\x01\n\r")
+	readPrompt(t, cc2, "Thanks for Joining!")
+	// the client not telling its terminal type is told plain text.
+	readPrompt(t, cc2, plainRenderer{}.info("ankur", metaRoom))
+
+	// the conn is closed after too many failed login attempts.
+	sc3, cc3 := net.Pipe()
+	go ts.serveConn(sc3)
+	readPrompt(t, cc3, welcomeMsg)
+	for i := 0; i < maxLoginAttempts; i++ {
+		writeMsg(t, cc3, []byte("ankur\n\r"))
+		readPrompt(t, cc3, "Password: ")
+		writeMsg(t, cc3, []byte("guess\n\r"))
+		readPrompt(t, cc3, "\xff\xfc\x01\n\r")
+		if i < maxLoginAttempts-1 {
+			readPrompt(t, cc3, "wrong password, try again")
+		}
+	}
+	readPrompt(t, cc3, "too many failed login attempts")
+	must(t, cc3.SetDeadline(time.Now().Add(time.Second)))
+	if _, err := cc3.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("expected conn to be closed")
+	}
+}
+
+func TestRendererServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc, cc := net.Pipe()
+	go ts.serveConn(sc)
+	readPrompt(t, cc, "\xff\xfd\x18"+welcomeMsg)
+	// a dumb terminal is told plain text.
+	writeMsg(t, cc, []byte("\xff\xfb\x18\xff\xfa\x18\x00DUMB\xff\xf0ankur\r\n"))
+	readPrompt(t, cc, "\xff\xfa\x18\x01\xff\xf0")
+	readPrompt(t, cc, "Thanks for Joining!")
+	readPrompt(t, cc, plainRenderer{}.info("ankur", metaRoom))
+
+	writeMsg(t, cc, []byte("/set color on\r\n"))
+	readPrompt(t, cc, formatSystemMsg(metaRoom, "color on"))
+	writeMsg(t, cc, []byte("/info\r\n"))
+	readPrompt(t, cc, infoDisplay("ankur", metaRoom))
+	writeMsg(t, cc, []byte("/set color off\r\n"))
+	readPrompt(t, cc, "*** default color off")
+	writeMsg(t, cc, []byte("/set colour on\r\n"))
+	readPrompt(t, cc, "[Error]: invalid command `/set colour on`")
+	writeMsg(t, cc, []byte("/room who\r\n"))
+	readPrompt(t, cc, "[default] 1 members: ankur")
+}
+
+func TestLineEditingServeConn(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	sc1, cc1 := net.Pipe()
+	go ts.serveConn(sc1)
+	readPrompt(t, cc1, "\xff\xfd\x18"+welcomeMsg)
+	// the client accepting the echo is in character mode, the server echoes the typed keys.
+	writeMsg(t, cc1, []byte(xtermType+"\xff\xfd\x01\xff\xfd\x03ankur\r\x00"))
+	readPrompt(t, cc1, "\xff\xfa\x18\x01\xff\xf0")
+	readPrompt(t, cc1, "ankur\r\n")
+	readPrompt(t, cc1, "Thanks for Joining!")
+	readPrompt(t, cc1, infoDisplay("ankur", metaRoom))
+
+	sc2, cc2 := net.Pipe()
+	go ts.serveConn(sc2)
+	initialRead(t, cc2, []byte("anand\n\r"))
+	drainMsgs(t, cc1)
+
+	writeMsg(t, cc1, []byte("hel"))
+	readPrompt(t, cc1, "hel")
+	// the line being typed is redrawn below the messages received.
+	writeMsg(t, cc2, []byte("hi all\n\r"))
+	readM := make([]byte, 512)
+	n, err := cc1.Read(readM)
+	must(t, err)
+	if got := string(readM[:n]); !strings.HasPrefix(got, "\r\033[K") || !strings.Contains(got, "hi all") || !strings.HasSuffix(got, "\rhel") {
+		t.Errorf("expected the message above the typed line got %q", got)
+	}
+
+	writeMsg(t, cc1, []byte("\x7f"))
+	readPrompt(t, cc1, "\b \b")
+	writeMsg(t, cc1, []byte("\x15"))
+	readPrompt(t, cc1, "\r\033[K")
+	// the up arrow recalls the previous line.
+	writeMsg(t, cc1, []byte("\x1b[A"))
+	readPrompt(t, cc1, "\r\033[Kankur")
+	writeMsg(t, cc1, []byte("\x15/info\r\x00"))
+	readPrompt(t, cc1, "\r\033[K/info\r\n")
+	readPrompt(t, cc1, infoDisplay("ankur", metaRoom))
+
+	// the line wrapped over the window told by NAWS is erased from its first row.
+	writeMsg(t, cc1, []byte("\xff\xfb\x1f\xff\xfa\x1f\x00\x04\x00\x18\xff\xf0hello!"))
+	readPrompt(t, cc1, "hello!")
+	writeMsg(t, cc1, []byte("\x15"))
+	readPrompt(t, cc1, "\033[1A\r\033[J")
+}
@@ -0,0 +1,418 @@
+package pkg
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// telnet commands and options, RFC 854, RFC 857, RFC 858, RFC 1073 and RFC 1091.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+
+	ttypeIS   = 0
+	ttypeSEND = 1
+
+	// maxSubNegotiation bounds the sub negotiation buffered from a client.
+	maxSubNegotiation = 64
+)
+
+// termCaps are the terminal capabilities negotiated with the telnet client.
+type termCaps struct {
+	// Width and Height of the client window, zero if not told (NAWS).
+	Width, Height int
+	// TermType is the terminal type of the client, like "XTERM-256COLOR", empty if not told (TTYPE).
+	TermType string
+	// SuppressGoAhead is true once the server suppresses the go ahead (SGA).
+	SuppressGoAhead bool
+	// Echo is true while the server echoes the input, and the client does not.
+	Echo bool
+}
+
+// telnetOption is the negotiation state of an option on one side of the connection.
+type telnetOption struct {
+	enabled bool
+	// pending is true while a request sent for the option is not answered yet,
+	// the answer is not replied to, which prevents negotiation loops.
+	pending bool
+}
+
+// telnetParseState is the state of the telnet command parser.
+type telnetParseState int
+
+const (
+	parseData telnetParseState = iota
+	parseIAC
+	parseOption
+	parseSB
+	parseSBIAC
+)
+
+// telnetConn is a net.Conn speaking the telnet protocol. The reads strip the telnet
+// commands from the input and answer the option negotiation of the client.
+// The server offers to echo and suppress the go ahead, and asks the window size and terminal type.
+// Once the client accepts the echo, it's in character mode and the reads edit the typed line,
+// returning it once entered. The writes then redraw the partial line below the text written,
+// the line wraps over the rows of the window size told by the client.
+// The writes escape the 255 byte of IAC, the telnet commands are sent ahead of the next write.
+// It holds the renderer of the client terminal.
+type telnetConn struct {
+	net.Conn
+	renderSetting
+
+	mu   sync.Mutex // guards the below options and caps.
+	us   [256]telnetOption
+	him  [256]telnetOption
+	caps termCaps
+
+	wmu  sync.Mutex // guards the below line editor and commands, and the writes against the echo.
+	ed   lineEditor
+	cmds []byte // sent ahead of the next write.
+
+	// parser state, only used by the reader.
+	state telnetParseState
+	cmd   byte
+	sb    []byte
+	cr    bool
+	rbuf  []byte
+	lines []byte // read, but not returned yet.
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{Conn: conn, rbuf: make([]byte, 1024)}
+}
+
+// startNegotiation returns the telnet commands opening the option negotiation.
+// They must be sent with queueCommand, not written, as the writes escape them.
+func (tc *telnetConn) startNegotiation() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	var b []byte
+	b = append(b, tc.request(&tc.us, telnetOptEcho, true)...)
+	b = append(b, tc.request(&tc.us, telnetOptSGA, true)...)
+	b = append(b, tc.request(&tc.him, telnetOptNAWS, true)...)
+	b = append(b, tc.request(&tc.him, telnetOptTType, true)...)
+	return string(b)
+}
+
+// capabilities returns the terminal capabilities negotiated so far.
+func (tc *telnetConn) capabilities() termCaps {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.caps
+}
+
+// request returns the command asking to turn the option on or off, on our side
+// (us) or the client side (him). It's empty if the option is already so.
+// It must be called with the mu held.
+func (tc *telnetConn) request(side *[256]telnetOption, opt byte, on bool) []byte {
+	o := &side[opt]
+	if o.enabled == on && !o.pending {
+		return nil
+	}
+	o.enabled = on
+	o.pending = true
+	tc.updateCaps(side, opt, on)
+	return []byte{telnetIAC, optionCommand(side == &tc.us, on), opt}
+}
+
+// optionCommand returns the command turning an option on or off,
+// on our side (WILL/WONT) or on the client side (DO/DONT).
+func optionCommand(us bool, on bool) byte {
+	switch {
+	case us && on:
+		return telnetWILL
+	case us:
+		return telnetWONT
+	case on:
+		return telnetDO
+	default:
+		return telnetDONT
+	}
+}
+
+// supported returns true if the option can be turned on when asked by the client.
+func supported(us bool, opt byte) bool {
+	if us {
+		return opt == telnetOptEcho || opt == telnetOptSGA
+	}
+	return opt == telnetOptNAWS || opt == telnetOptTType
+}
+
+// negotiate answers the cmd of the client for the option, it returns the reply to send.
+// It must be called with the mu held.
+func (tc *telnetConn) negotiate(cmd, opt byte) []byte {
+	// DO and DONT are about our side, WILL and WONT about the client one.
+	us := cmd == telnetDO || cmd == telnetDONT
+	on := cmd == telnetDO || cmd == telnetWILL
+	side := &tc.him
+	if us {
+		side = &tc.us
+	}
+	o := &side[opt]
+	var reply []byte
+	switch {
+	case o.pending:
+		// answer to our request, the client is free to refuse it.
+		o.pending = false
+		o.enabled = on
+	case on == o.enabled:
+		return nil
+	case on && !supported(us, opt):
+		return []byte{telnetIAC, optionCommand(us, false), opt}
+	default:
+		o.enabled = on
+		reply = []byte{telnetIAC, optionCommand(us, on), opt}
+	}
+	tc.updateCaps(side, opt, o.enabled)
+	if !us && opt == telnetOptTType && o.enabled {
+		reply = append(reply, telnetIAC, telnetSB, telnetOptTType, ttypeSEND, telnetIAC, telnetSE)
+	}
+	return reply
+}
+
+// updateCaps records the option state in the caps.
+// It must be called with the mu held.
+func (tc *telnetConn) updateCaps(side *[256]telnetOption, opt byte, on bool) {
+	if side != &tc.us {
+		return
+	}
+	switch opt {
+	case telnetOptSGA:
+		tc.caps.SuppressGoAhead = on
+	case telnetOptEcho:
+		tc.caps.Echo = on
+	}
+}
+
+// subNegotiation records the window size and terminal type sent by the client.
+// It must be called with the mu held.
+func (tc *telnetConn) subNegotiation(sb []byte) {
+	if len(sb) == 0 {
+		return
+	}
+	switch sb[0] {
+	case telnetOptNAWS:
+		if len(sb) == 5 {
+			tc.caps.Width = int(sb[1])<<8 | int(sb[2])
+			tc.caps.Height = int(sb[3])<<8 | int(sb[4])
+		}
+	case telnetOptTType:
+		if len(sb) > 2 && sb[1] == ttypeIS {
+			tc.caps.TermType = string(sb[2:])
+		}
+	}
+}
+
+// isEditing returns true once the client accepted the server echo.
+func (tc *telnetConn) isEditing() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	o := tc.us[telnetOptEcho]
+	return o.enabled && !o.pending
+}
+
+// Read reads the data sent by the client, without the telnet commands.
+// In character mode only the entered lines are returned.
+func (tc *telnetConn) Read(p []byte) (int, error) {
+	for len(tc.lines) == 0 {
+		n, err := tc.Conn.Read(tc.rbuf)
+		data, reply := tc.parse(tc.rbuf[:n], nil)
+		if len(reply) != 0 {
+			_, werr := tc.Conn.Write(reply)
+			if werr != nil {
+				log.Println("telnet negotiation write failed, err: ", werr)
+			}
+		}
+		tc.lines = append(tc.lines, tc.edit(data)...)
+		if err != nil {
+			n := copy(p, tc.lines)
+			tc.lines = tc.lines[n:]
+			return n, err
+		}
+	}
+	n := copy(p, tc.lines)
+	tc.lines = tc.lines[n:]
+	return n, nil
+}
+
+// edit feeds the data to the line editor in character mode, and echoes it.
+// It returns the lines entered, the data is returned as is in line mode.
+func (tc *telnetConn) edit(data []byte) []byte {
+	// in line mode the reads don't wait for the writes to a slow client.
+	if len(data) == 0 || !tc.isEditing() {
+		return data
+	}
+	cols := tc.capabilities().Width
+	tc.wmu.Lock()
+	defer tc.wmu.Unlock()
+	tc.ed.cols = cols
+	var lines, echo []byte
+	r := tc.renderer()
+	for _, c := range data {
+		e, line, entered := tc.ed.feed(c, r)
+		echo = append(echo, e...)
+		if entered {
+			lines = append(lines, line...)
+			lines = append(lines, '\r', '\n')
+		}
+	}
+	if len(echo) != 0 {
+		_, err := io.WriteString(tc.Conn, escapeIAC(string(echo)))
+		if err != nil {
+			log.Println("telnet echo write failed, err: ", err)
+		}
+	}
+	return lines
+}
+
+// Write writes p to the client, redrawing the line being typed below it in character mode.
+// The IAC bytes of p are escaped, so that a client can't send telnet commands to the others.
+func (tc *telnetConn) Write(p []byte) (int, error) {
+	editing := tc.isEditing()
+	cols := tc.capabilities().Width
+	tc.wmu.Lock()
+	defer tc.wmu.Unlock()
+	text := string(p)
+	if editing {
+		// the window size may have been told since the last key typed.
+		tc.ed.cols = cols
+		text = tc.ed.redraw(text, tc.renderer())
+	}
+	out := append(tc.cmds, escapeIAC(text)...)
+	tc.cmds = nil
+	_, err := tc.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// escapeIAC doubles the IAC bytes of the data sent, RFC 854.
+func escapeIAC(s string) string {
+	return strings.ReplaceAll(s, "\xff", "\xff\xff")
+}
+
+// queueCommand queues the telnet command to be sent ahead of the next write.
+func (tc *telnetConn) queueCommand(cmd []byte) {
+	tc.wmu.Lock()
+	defer tc.wmu.Unlock()
+	tc.cmds = append(tc.cmds, cmd...)
+}
+
+// setEcho asks the client to echo its input or not, the command is sent ahead of the next write.
+// In character mode the server stops echoing itself instead.
+func (tc *telnetConn) setEcho(on bool) error {
+	if tc.isEditing() {
+		tc.wmu.Lock()
+		tc.ed.masked = !on
+		tc.wmu.Unlock()
+		return nil
+	}
+	tc.mu.Lock()
+	cmd := tc.request(&tc.us, telnetOptEcho, !on)
+	tc.mu.Unlock()
+	tc.queueCommand(cmd)
+	return nil
+}
+
+// parse appends the data bytes of in to out, and returns the replies to the commands.
+func (tc *telnetConn) parse(in, out []byte) ([]byte, []byte) {
+	var reply []byte
+	for _, c := range in {
+		switch tc.state {
+		case parseData:
+			switch {
+			case c == telnetIAC:
+				tc.state = parseIAC
+			case tc.cr && c == 0:
+				// CR NUL is a bare carriage return, sent on enter by the clients in character mode.
+				out = append(out, '\n')
+				tc.cr = false
+			default:
+				out = append(out, c)
+				tc.cr = c == '\r'
+			}
+		case parseIAC:
+			switch c {
+			case telnetIAC:
+				// escaped 255 data byte.
+				out = append(out, c)
+				tc.state = parseData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				tc.cmd = c
+				tc.state = parseOption
+			case telnetSB:
+				tc.sb = tc.sb[:0]
+				tc.state = parseSB
+			default:
+				// NOP, GA and the other commands without option are ignored.
+				tc.state = parseData
+			}
+		case parseOption:
+			tc.mu.Lock()
+			reply = append(reply, tc.negotiate(tc.cmd, c)...)
+			tc.mu.Unlock()
+			tc.state = parseData
+		case parseSB:
+			if c == telnetIAC {
+				tc.state = parseSBIAC
+			} else if len(tc.sb) < maxSubNegotiation {
+				tc.sb = append(tc.sb, c)
+			}
+		case parseSBIAC:
+			switch c {
+			case telnetSE:
+				tc.mu.Lock()
+				tc.subNegotiation(tc.sb)
+				tc.mu.Unlock()
+				tc.state = parseData
+			case telnetIAC:
+				if len(tc.sb) < maxSubNegotiation {
+					tc.sb = append(tc.sb, c)
+				}
+				tc.state = parseSB
+			default:
+				tc.state = parseSB
+			}
+		}
+	}
+	return out, reply
+}
+
+// echoController is implemented by the conns that can stop echoing the typed input themselves,
+// like the telnet conn, or the websocket conn that doesn't speak the telnet protocol.
+type echoController interface {
+	setEcho(on bool) error
+}
+
+// echoCommand returns the telnet command that asks the client to stop echoing the
+// typed input, like a password, when on is false. The server announces that it will
+// echo (and does not), which turns off the local echo of the client.
+func echoCommand(conn net.Conn, on bool) (string, error) {
+	if ec, ok := conn.(echoController); ok {
+		return "", ec.setEcho(on)
+	}
+	return string([]byte{telnetIAC, optionCommand(true, !on), telnetOptEcho}), nil
+}
+
+// openNegotiation opens the option negotiation of the telnet conns,
+// the commands are sent along with the welcome message.
+func openNegotiation(conn net.Conn) {
+	if tc, ok := conn.(*telnetConn); ok {
+		tc.queueCommand([]byte(tc.startNegotiation()))
+	}
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTelnetConnParse(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{name: "plain", in: "hello", out: "hello"},
+		{name: "negotiation", in: "\xff\xfd\x03s3cret", out: "s3cret"},
+		{name: "between", in: "s3\xff\xfe\x01cret", out: "s3cret"},
+		{name: "sub negotiation", in: "\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0hello", out: "hello"},
+		{name: "escaped", in: "a\xff\xffb", out: "a\xffb"},
+		{name: "command", in: "\xff\xf1hello", out: "hello"},
+		{name: "carriage return", in: "hello\r\x00", out: "hello\r\n"},
+	}
+	for _, tc := range tcs {
+		conn := newTelnetConn(nil)
+		out, _ := conn.parse([]byte(tc.in), nil)
+		if string(out) != tc.out {
+			t.Errorf("%s: expected %q got %q", tc.name, tc.out, out)
+		}
+		// the commands split across the reads are parsed the same.
+		conn = newTelnetConn(nil)
+		out = out[:0]
+		for i := 0; i < len(tc.in); i++ {
+			out, _ = conn.parse([]byte(tc.in[i:i+1]), out)
+		}
+		if string(out) != tc.out {
+			t.Errorf("%s: expected %q got %q byte by byte", tc.name, tc.out, out)
+		}
+	}
+}
+
+func TestTelnetConnNegotiation(t *testing.T) {
+	t.Parallel()
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	conn := newTelnetConn(sc)
+	if neg := conn.startNegotiation(); neg != "\xff\xfb\x01\xff\xfb\x03\xff\xfd\x1f\xff\xfd\x18" {
+		t.Errorf("expected WILL ECHO, WILL SGA, DO NAWS, DO TTYPE got %q", neg)
+	}
+	if neg := conn.startNegotiation(); neg != "\xff\xfb\x01\xff\xfb\x03\xff\xfd\x1f\xff\xfd\x18" {
+		t.Errorf("expected the pending requests to be sent again got %q", neg)
+	}
+
+	read := make(chan string)
+	go func() {
+		b := make([]byte, 64)
+		n, err := conn.Read(b)
+		must(t, err)
+		read <- string(b[:n])
+	}()
+	readReply := func(exp string) {
+		t.Helper()
+		must(t, cc.SetReadDeadline(time.Now().Add(time.Second)))
+		b := make([]byte, 64)
+		n, err := cc.Read(b)
+		must(t, err)
+		if string(b[:n]) != exp {
+			t.Errorf("expected reply %q got %q", exp, b[:n])
+		}
+	}
+
+	// the answers to the requests are not replied to, but TTYPE is asked for.
+	// The client refusing the echo stays in line mode.
+	writeMsg(t, cc, []byte("\xff\xfe\x01\xff\xfd\x03\xff\xfb\x1f\xff\xfb\x18"))
+	readReply("\xff\xfa\x18\x01\xff\xf0")
+	// the unsupported options are refused.
+	writeMsg(t, cc, []byte("\xff\xfd\x05\xff\xfb\x05"))
+	readReply("\xff\xfc\x05\xff\xfe\x05")
+	writeMsg(t, cc, []byte("\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0\xff\xfa\x18\x00XTERM-256COLOR\xff\xf0hi\r\n"))
+	if data := <-read; data != "hi\r\n" {
+		t.Errorf("expected data hi got %q", data)
+	}
+	caps := conn.capabilities()
+	exp := termCaps{Width: 80, Height: 24, TermType: "XTERM-256COLOR", SuppressGoAhead: true}
+	if caps != exp {
+		t.Errorf("expected caps %+v got %+v", exp, caps)
+	}
+
+	// the client turning off the option enabled is acknowledged.
+	go func() {
+		b := make([]byte, 64)
+		n, _ := conn.Read(b)
+		read <- string(b[:n])
+	}()
+	writeMsg(t, cc, []byte("\xff\xfe\x03"))
+	readReply("\xff\xfc\x03")
+	writeMsg(t, cc, []byte("x"))
+	<-read
+	if conn.capabilities().SuppressGoAhead {
+		t.Error("expected go ahead to not be suppressed")
+	}
+}
+
+func TestEchoCommand(t *testing.T) {
+	t.Parallel()
+	sc, _ := net.Pipe()
+	off, err := echoCommand(sc, false)
+	must(t, err)
+	if off != "\xff\xfb\x01" {
+		t.Errorf("expected IAC WILL ECHO got %q", off)
+	}
+	on, err := echoCommand(sc, true)
+	must(t, err)
+	if on != "\xff\xfc\x01" {
+		t.Errorf("expected IAC WONT ECHO got %q", on)
+	}
+
+	// the telnet conn queues the commands, only to change the echo.
+	conn := newTelnetConn(sc)
+	on, err = echoCommand(conn, true)
+	must(t, err)
+	if on != "" || len(conn.cmds) != 0 {
+		t.Errorf("expected no telnet command got %q %q", on, conn.cmds)
+	}
+	off, err = echoCommand(conn, false)
+	must(t, err)
+	if off != "" || string(conn.cmds) != "\xff\xfb\x01" || !conn.capabilities().Echo {
+		t.Errorf("expected IAC WILL ECHO got %q %q", off, conn.cmds)
+	}
+	conn.cmds = nil
+	conn.parse([]byte("\xff\xfd\x01"), nil)
+	off, err = echoCommand(conn, false)
+	must(t, err)
+	if off != "" || len(conn.cmds) != 0 {
+		t.Errorf("expected no telnet command got %q %q", off, conn.cmds)
+	}
+
+	// the websocket conns don't speak telnet.
+	off, err = echoCommand(&wsConn{}, false)
+	must(t, err)
+	if off != "" {
+		t.Errorf("expected no telnet command got %q", off)
+	}
+}
+
+func TestTelnetConnWriteEscapesIAC(t *testing.T) {
+	t.Parallel()
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	conn := newTelnetConn(sc)
+	// the queued commands are sent as is, ahead of the data escaped.
+	conn.queueCommand([]byte{telnetIAC, telnetWILL, telnetOptEcho})
+	go func() {
+		_, err := conn.Write([]byte("x\xff\xfc\x01"))
+		must(t, err)
+	}()
+	b := make([]byte, 64)
+	must(t, cc.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := cc.Read(b)
+	must(t, err)
+	if got := string(b[:n]); got != "\xff\xfb\x01x\xff\xff\xfc\x01" {
+		t.Errorf("expected the IAC escaped got %q", got)
+	}
+}
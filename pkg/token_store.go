@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownToken = errors.New("unknown token")
+	errEmptyName    = errors.New("name cannot be empty")
+)
+
+// apiToken is a REST API token issued to a chat name.
+type apiToken struct {
+	ID   string   `json:"id"`
+	Name clientID `json:"name"`
+	// Hash is the hex SHA-256 of the token, the token itself is only shown when issued.
+	// The tokens are random, so unlike the passwords they don't need a slow salted hash.
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// tokenStore holds the issued API tokens, persisted to the JSON file at path.
+// An empty path keeps the tokens in memory only.
+// The file is reloaded once changed, so that the tokens issued or revoked
+// from the command line apply to a running server.
+type tokenStore struct {
+	path   string
+	lock   sync.Mutex
+	loaded os.FileInfo          // of the file loaded last, nil if none.
+	tokens map[string]*apiToken // by hash.
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: make(map[string]*apiToken)}
+}
+
+// openTokenStore loads the tokens persisted at path.
+func openTokenStore(path string) (*tokenStore, error) {
+	ts := newTokenStore()
+	ts.path = path
+	if path == "" {
+		return ts, nil
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// hashToken returns the hex SHA-256 of the token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// issue creates a new token for the name, the returned token is not stored and can't be recovered.
+func (ts *tokenStore) issue(name string) (apiToken, string, error) {
+	if name == "" {
+		return apiToken{}, "", errEmptyName
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return apiToken{}, "", err
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return apiToken{}, "", err
+	}
+	t := &apiToken{ID: id, Name: clientID(name), Hash: hashToken(token), CreatedAt: time.Now().UTC()}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	err = ts.reload()
+	if err != nil {
+		return apiToken{}, "", err
+	}
+	ts.tokens[t.Hash] = t
+	err = ts.save()
+	if err != nil {
+		delete(ts.tokens, t.Hash)
+		return apiToken{}, "", err
+	}
+	return t.public(), token, nil
+}
+
+// revoke deletes the token with the id.
+func (ts *tokenStore) revoke(id string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	err := ts.reload()
+	if err != nil {
+		return err
+	}
+	for hash, t := range ts.tokens {
+		if t.ID == id {
+			delete(ts.tokens, hash)
+			err = ts.save()
+			if err != nil {
+				ts.tokens[hash] = t
+			}
+			return err
+		}
+	}
+	return errUnknownToken
+}
+
+// identify returns the name the token was issued to.
+func (ts *tokenStore) identify(token string) (clientID, bool) {
+	if token == "" {
+		return "", false
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	err := ts.reload()
+	if err != nil {
+		// keep serving the tokens loaded before.
+		log.Printf("unable to reload the tokens, err: %v\n", err)
+	}
+	t, ok := ts.tokens[hashToken(token)]
+	if !ok {
+		return "", false
+	}
+	return t.Name, true
+}
+
+// list returns all the tokens without their hash, sorted by name.
+func (ts *tokenStore) list() ([]apiToken, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	err := ts.reload()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]apiToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t.public())
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Name != tokens[j].Name {
+			return tokens[i].Name < tokens[j].Name
+		}
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// public returns the token without its hash.
+func (t *apiToken) public() apiToken {
+	p := *t
+	p.Hash = ""
+	return p
+}
+
+// reload loads the tokens again if the file changed since the last load.
+// It must be called with the lock held.
+func (ts *tokenStore) reload() error {
+	if ts.path == "" {
+		return nil
+	}
+	fi, err := os.Stat(ts.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the file is replaced on each save, so a new file is a change
+	// even if written within the mod time resolution.
+	if ts.loaded != nil && os.SameFile(fi, ts.loaded) && fi.ModTime().Equal(ts.loaded.ModTime()) && fi.Size() == ts.loaded.Size() {
+		return nil
+	}
+	return ts.load()
+}
+
+// load replaces the tokens with the ones persisted.
+// It must be called with the lock held.
+func (ts *tokenStore) load() error {
+	fi, err := os.Stat(ts.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var tokens []*apiToken
+	err = loadJSONFile(ts.path, &tokens)
+	if err != nil {
+		return err
+	}
+	ts.tokens = make(map[string]*apiToken, len(tokens))
+	for _, t := range tokens {
+		ts.tokens[t.Hash] = t
+	}
+	ts.loaded = fi
+	return nil
+}
+
+// save persists all the tokens.
+// It must be called with the lock held.
+func (ts *tokenStore) save() error {
+	if ts.path == "" {
+		return nil
+	}
+	tokens := make([]*apiToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
+	err := saveJSONFile(ts.path, tokens)
+	if err != nil {
+		return err
+	}
+	ts.loaded, err = os.Stat(ts.path)
+	return err
+}
+
+// IssueToken issues a REST API token for the name in the tokens file at path.
+// It returns the token id, used to revoke it, and the token.
+func IssueToken(path, name string) (string, string, error) {
+	ts, err := openTokenStore(path)
+	if err != nil {
+		return "", "", err
+	}
+	t, token, err := ts.issue(name)
+	return t.ID, token, err
+}
+
+// RevokeToken revokes the REST API token with the id in the tokens file at path.
+func RevokeToken(path, id string) error {
+	ts, err := openTokenStore(path)
+	if err != nil {
+		return err
+	}
+	return ts.revoke(id)
+}
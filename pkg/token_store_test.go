@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenStore(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	ts, err := openTokenStore(path)
+	must(t, err)
+
+	if _, _, err := ts.issue(""); err != errEmptyName {
+		t.Errorf("expected empty name err got %v", err)
+	}
+	tok, token, err := ts.issue("ankur")
+	must(t, err)
+	if name, ok := ts.identify(token); !ok || name != "ankur" {
+		t.Errorf("expected token of ankur got %s", name)
+	}
+	if _, ok := ts.identify("guess"); ok {
+		t.Error("expected unknown token to be rejected")
+	}
+	data, err := ioutil.ReadFile(path)
+	must(t, err)
+	if bytes.Contains(data, []byte(token)) {
+		t.Error("expected token to be stored hashed")
+	}
+
+	// the tokens issued and revoked by the command line apply to the running store.
+	id, other, err := IssueToken(path, "anand")
+	must(t, err)
+	if name, ok := ts.identify(other); !ok || name != "anand" {
+		t.Errorf("expected token of anand got %s", name)
+	}
+	must(t, RevokeToken(path, tok.ID))
+	if _, ok := ts.identify(token); ok {
+		t.Error("expected revoked token to be rejected")
+	}
+	if err := RevokeToken(path, tok.ID); err != errUnknownToken {
+		t.Errorf("expected unknown token err got %v", err)
+	}
+	must(t, ts.revoke(id))
+	tokens, err := ts.list()
+	must(t, err)
+	if len(tokens) != 0 {
+		t.Errorf("expected no tokens got %+v", tokens)
+	}
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errAlreadyRegistered = errors.New("name already registered")
+	errBadCredentials    = errors.New("wrong name or password")
+	errEmptyPassword     = errors.New("password cannot be empty")
+)
+
+// userAccount is a registered chat name with its credentials.
+type userAccount struct {
+	Name clientID `json:"name"`
+	// PasswordHash is the salted bcrypt hash of the account password.
+	PasswordHash []byte    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// userStore holds the registered accounts, persisted to the JSON file at path.
+// An empty path keeps the accounts in memory only.
+type userStore struct {
+	path  string
+	lock  sync.RWMutex
+	users map[clientID]*userAccount
+}
+
+func newUserStore() *userStore {
+	return &userStore{users: make(map[clientID]*userAccount)}
+}
+
+// openUserStore loads the accounts persisted at path.
+func openUserStore(path string) (*userStore, error) {
+	us := newUserStore()
+	us.path = path
+	if path == "" {
+		return us, nil
+	}
+	var users []*userAccount
+	err := loadJSONFile(path, &users)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		us.users[u.Name] = u
+	}
+	return us, nil
+}
+
+// isRegistered returns true if the name belongs to a registered account.
+func (us *userStore) isRegistered(name string) bool {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	_, ok := us.users[clientID(name)]
+	return ok
+}
+
+// register creates the account of the name with the password.
+func (us *userStore) register(name, password string) error {
+	if password == "" {
+		return errEmptyPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return err
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	cid := clientID(name)
+	if _, ok := us.users[cid]; ok {
+		return errAlreadyRegistered
+	}
+	us.users[cid] = &userAccount{Name: cid, PasswordHash: hash, CreatedAt: time.Now().UTC()}
+	err = us.save()
+	if err != nil {
+		delete(us.users, cid)
+	}
+	return err
+}
+
+// authenticate checks the password of the registered account.
+func (us *userStore) authenticate(name, password string) error {
+	us.lock.RLock()
+	u, ok := us.users[clientID(name)]
+	us.lock.RUnlock()
+	if !ok {
+		return errBadCredentials
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+		return errBadCredentials
+	}
+	return nil
+}
+
+// save persists all the accounts.
+// It must be called with the lock held.
+func (us *userStore) save() error {
+	if us.path == "" {
+		return nil
+	}
+	users := make([]*userAccount, 0, len(us.users))
+	for _, u := range us.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return saveJSONFile(us.path, users)
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	us, err := openUserStore(path)
+	must(t, err)
+
+	if err := us.register("ankur", ""); err != errEmptyPassword {
+		t.Errorf("expected empty password err got %v", err)
+	}
+	must(t, us.register("ankur", "s3cret"))
+	if err := us.register("ankur", "other"); err != errAlreadyRegistered {
+		t.Errorf("expected already registered err got %v", err)
+	}
+	if !us.isRegistered("ankur") || us.isRegistered("anand") {
+		t.Error("unexpected registered accounts")
+	}
+
+	// the accounts survive restarts, with the password stored hashed.
+	data, err := ioutil.ReadFile(path)
+	must(t, err)
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Error("expected password to be stored hashed")
+	}
+	us, err = openUserStore(path)
+	must(t, err)
+	must(t, us.authenticate("ankur", "s3cret"))
+	if err := us.authenticate("ankur", "guess"); err != errBadCredentials {
+		t.Errorf("expected bad credentials err got %v", err)
+	}
+	if err := us.authenticate("anand", "s3cret"); err != errBadCredentials {
+		t.Errorf("expected bad credentials err got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn adapts a websocket connection to the net.Conn line protocol used by the telnetHandler.
+// Each received text frame is read as a single line and each write is sent as a single text frame.
+type wsConn struct {
+	ws     *websocket.Conn
+	wLock  sync.Mutex // websocket supports a single concurrent writer.
+	remain []byte     // unread part of the last received frame
+	renderSetting
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	c := &wsConn{ws: ws}
+	// the browsers don't interpret the escape sequences.
+	c.setRenderer(plainRenderer{})
+	return c
+}
+
+// Read reads the next received frame terminated by a new line.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.remain) == 0 {
+		mt, data, err := c.ws.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if mt != websocket.TextMessage && mt != websocket.BinaryMessage {
+			continue
+		}
+		c.remain = append(data, '\n')
+	}
+	n := copy(p, c.remain)
+	c.remain = c.remain[n:]
+	return n, nil
+}
+
+// Write sends p as a single text frame.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	err := c.ws.WriteMessage(websocket.TextMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends the close frame and closes the underlying connection.
+func (c *wsConn) Close() error {
+	c.wLock.Lock()
+	err := c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wLock.Unlock()
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		log.Printf("unable to send websocket close frame, err: %v\n", err)
+	}
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	return c.ws.SetWriteDeadline(t)
+}
+
+// webSocketHandler upgrades the http request to websocket and serves it
+// with the same command loop as the telnet connection's.
+// chat messages are delivered to the websocket client as JSON records.
+type webSocketHandler struct {
+	upgrader      websocket.Upgrader
+	telnetHandler *telnetHandler
+}
+
+func newWebSocketHandler(th *telnetHandler) *webSocketHandler {
+	return &webSocketHandler{
+		upgrader:      websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024},
+		telnetHandler: th,
+	}
+}
+
+func (wh *webSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := wh.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader has already replied with the http error.
+		log.Printf("websocket upgrade failed, err: %v\n", err)
+		return
+	}
+	conn := newWSConn(ws)
+	wh.telnetHandler.serveSession(conn, newJSONSession(conn), originWebSocket)
+}
+
+// setEcho is a noop, the browser clients control the echo of their own input.
+func (c *wsConn) setEcho(on bool) error {
+	return nil
+}
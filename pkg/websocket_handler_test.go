@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWS(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func readWS(t *testing.T, ws *websocket.Conn) ([]byte, error) {
+	t.Helper()
+	err := ws.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	must(t, err)
+	_, data, err := ws.ReadMessage()
+	return data, err
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	srv := httptest.NewServer(newWebSocketHandler(ts))
+	defer srv.Close()
+
+	ws := dialWS(t, srv)
+	defer ws.Close()
+	// welcome
+	_, err := readWS(t, ws)
+	must(t, err)
+	must(t, ws.WriteMessage(websocket.TextMessage, []byte("ankur")))
+	// help and info
+	_, err = readWS(t, ws)
+	must(t, err)
+	data, err := readWS(t, ws)
+	must(t, err)
+	// the replies are plain text, the browsers don't interpret the escape sequences.
+	if !bytes.Equal(data, []byte(plainRenderer{}.info("ankur", metaRoom))) {
+		t.Errorf("expected info prompt got %q", data)
+	}
+
+	// telnet user in the same chat store.
+	sc, cc := net.Pipe()
+	go ts.serveConn(sc)
+	initialRead(t, cc, []byte("anand\n\r"))
+	data, err = readWS(t, ws)
+	must(t, err)
+	var notice chatMessage
+	must(t, json.Unmarshal(data, &notice))
+	if notice.Kind != kindSystem || notice.Body != "anand joined #default" {
+		t.Errorf("expected join notice got %s", data)
+	}
+
+	// websocket to telnet
+	must(t, ws.WriteMessage(websocket.TextMessage, []byte("hello from browser")))
+	readM := make([]byte, 512)
+	err = readMsg(t, cc, readM)
+	must(t, err)
+	if !bytes.Contains(readM, []byte("hello from browser")) {
+		t.Errorf("expected msg: %s not found in received msg", "hello from browser")
+	}
+
+	// telnet to websocket
+	writeMsg(t, cc, []byte("hello from telnet\n\r"))
+	data, err = readWS(t, ws)
+	must(t, err)
+	var m chatMessage
+	must(t, json.Unmarshal(data, &m))
+	if m.Body != "hello from telnet" || m.Sender != "anand" || m.Room != metaRoom || m.Origin != originTelnet {
+		t.Errorf("expected json message from anand got %s", data)
+	}
+
+	// commands work the same as on telnet.
+	must(t, ws.WriteMessage(websocket.TextMessage, []byte("/room change roomname")))
+	data, err = readWS(t, ws)
+	must(t, err)
+	if !bytes.Equal(data, []byte(plainRenderer{}.info("ankur", "roomname"))) {
+		t.Errorf("expected info prompt got %q", data)
+	}
+	writeMsg(t, cc, []byte("not in the room\n\r"))
+	_, err = readWS(t, ws)
+	if err == nil {
+		t.Error("expected read deadline error got nil")
+	}
+}
+
+func TestWebSocketHandlerOrigin(t *testing.T) {
+	t.Parallel()
+	ts := newTelnetS(ioutil.Discard)
+	srv := httptest.NewServer(newWebSocketHandler(ts))
+	defer srv.Close()
+
+	login := func(name string) *websocket.Conn {
+		ws := dialWS(t, srv)
+		// welcome
+		_, err := readWS(t, ws)
+		must(t, err)
+		must(t, ws.WriteMessage(websocket.TextMessage, []byte(name)))
+		// help and info
+		_, err = readWS(t, ws)
+		must(t, err)
+		_, err = readWS(t, ws)
+		must(t, err)
+		return ws
+	}
+	ankur := login("ankur")
+	defer ankur.Close()
+	anand := login("anand")
+	defer anand.Close()
+	// join notice
+	_, err := readWS(t, ankur)
+	must(t, err)
+
+	// the messages are recorded with the websocket origin.
+	must(t, anand.WriteMessage(websocket.TextMessage, []byte("hello from browser")))
+	must(t, anand.WriteMessage(websocket.TextMessage, []byte("/msg ankur privately from browser")))
+	for _, body := range []string{"hello from browser", "privately from browser"} {
+		data, err := readWS(t, ankur)
+		must(t, err)
+		var m chatMessage
+		must(t, json.Unmarshal(data, &m))
+		if m.Body != body || m.Origin != originWebSocket {
+			t.Errorf("expected %s from the websocket origin got %s", body, data)
+		}
+	}
+}